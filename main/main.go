@@ -7,6 +7,7 @@ import (
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/op/go-logging"
 	"github.com/shell909090/sshproxy/sshproxy"
+	"io/ioutil"
 	stdlog "log"
 	"os"
 )
@@ -18,6 +19,21 @@ type Config struct {
 	Loglevel string
 
 	WebHost string
+
+	// use database directly instead of web if DBFile is set.
+	DBFile  string
+	Listen  string
+	Hostkey string
+	Logdir  string
+	// file of user ca pubkeys, and KRL or revoked list.
+	UserCA      string
+	RevokedKeys string
+	// file of ca private key, to sign certificates for accounts.
+	AccountCA string
+	// tell user when an auditor watches the session.
+	LiveNotice bool
+	// cap of bandwidth of all channels, bytes per second, such as 10m.
+	RateLimit string
 }
 
 func LoadConfig() (cfg Config, err error) {
@@ -67,7 +83,83 @@ func SetLogging(cfg Config) (err error) {
 	return
 }
 
+func CreateBackend(cfg Config) (backend sshproxy.Backend, err error) {
+	if cfg.DBFile == "" {
+		return sshproxy.CreateWebBackend(cfg.WebHost), nil
+	}
+
+	hostkey, err := ioutil.ReadFile(cfg.Hostkey)
+	if err != nil {
+		return
+	}
+	var userca []byte
+	if cfg.UserCA != "" {
+		userca, err = ioutil.ReadFile(cfg.UserCA)
+		if err != nil {
+			return
+		}
+	}
+
+	var accountca []byte
+	if cfg.AccountCA != "" {
+		accountca, err = ioutil.ReadFile(cfg.AccountCA)
+		if err != nil {
+			return
+		}
+	}
+
+	return sshproxy.CreateSqliteBackend(cfg.DBFile, sshproxy.WebConfig{
+		Listen:      cfg.Listen,
+		Hostkey:     string(hostkey),
+		Logdir:      cfg.Logdir,
+		UserCA:      string(userca),
+		RevokedKeys: cfg.RevokedKeys,
+		AccountCA:   string(accountca),
+		LiveNotice:  cfg.LiveNotice,
+		RateLimit:   cfg.RateLimit,
+	})
+}
+
+// Export converts record file to asciicast v2,
+// usage: sshproxy export [-o output] recordfile.
+func Export(args []string) (err error) {
+	var output string
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	fs.StringVar(&output, "o", "", "output file, stdout if empty")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return fmt.Errorf("need one record file")
+	}
+
+	in, err := os.Open(fs.Arg(0))
+	if err != nil {
+		return
+	}
+	defer in.Close()
+
+	out := os.Stdout
+	if output != "" {
+		out, err = os.Create(output)
+		if err != nil {
+			return
+		}
+		defer out.Close()
+	}
+
+	return sshproxy.ExportAsciicast(in, out)
+}
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "export" {
+		err := Export(os.Args[2:])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(1)
+		}
+		return
+	}
+
 	cfg, err := LoadConfig()
 	if err != nil {
 		fmt.Println(err.Error())
@@ -79,7 +171,13 @@ func main() {
 		return
 	}
 
-	srv, err := sshproxy.CreateServer(cfg.WebHost)
+	backend, err := CreateBackend(cfg)
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+
+	srv, err := sshproxy.CreateServer(backend)
 	if err != nil {
 		fmt.Println(err.Error())
 		return
@@ -0,0 +1,321 @@
+package sshproxy
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const ADMIN_USAGE = `commands:
+  sessions                  list connections
+  kill <recordid> [delay]   disconnect session, warn user first if delay given
+  msg <recordid|all> <msg>  send message to shells of session, or all sessions
+  ban [<ip> [duration]]     ban ip, forever if no duration, list banned if no ip
+  unban <ip>                clear ban and failed count of ip
+  reload                    reload hostkey and CAs
+  hostkey <host|addr:port>  show host key of target, and check it against database
+`
+
+// AdminInfo runs admin commands against live state of server,
+// login as admin@_ and run commands by exec.
+type AdminInfo struct {
+	srv      *Server
+	Username string
+}
+
+func (ai *AdminInfo) init() (err error) {
+	user, err := ai.srv.GetUser(ai.Username)
+	if err != nil {
+		return
+	}
+	if !user.ChkRule("admin") {
+		return ErrNoPerms
+	}
+	return
+}
+
+func (ai *AdminInfo) sessions(w io.Writer) (err error) {
+	for _, ci := range ai.srv.Conns() {
+		in, out := ci.Bytes()
+		fmt.Fprintf(w, "%d\t%s\t%s@%s\t%s\t%s\tin: %d\tout: %d\n", ci.RecordId, ci.Username,
+			ci.Account, ci.Host, ci.Remote, ci.Starttime.Format(time.RFC3339), in, out)
+		for _, chi := range ci.Chans() {
+			fmt.Fprintf(w, "  %d\t%s\t%s\tin: %d\tout: %d\n", chi.RecordLogsId, chi.Type,
+				chi.Starttime.Format(time.RFC3339), chi.In.Count(), chi.Out.Count())
+		}
+	}
+
+	// connections not to target hosts.
+	ai.srv.mu.Lock()
+	var lines []string
+	for remote, scs := range ai.srv.scss {
+		switch s := scs.(type) {
+		case *ReviewInfo:
+			lines = append(lines, fmt.Sprintf("-\t%s\treview %d\t%s", s.Username, s.RecordLogsId, remote))
+		case *LiveInfo:
+			lines = append(lines, fmt.Sprintf("-\t%s\tlive %d\t%s", s.Username, s.RecordLogsId, remote))
+		case *JoinInfo:
+			lines = append(lines, fmt.Sprintf("-\t%s\tjoin %d\t%s", s.Username, s.RecordLogsId, remote))
+		case *MenuInfo:
+			lines = append(lines, fmt.Sprintf("-\t%s\tmenu\t%s", s.Username, remote))
+		case *AdminInfo:
+			lines = append(lines, fmt.Sprintf("-\t%s\tadmin\t%s", s.Username, remote))
+		}
+	}
+	ai.srv.mu.Unlock()
+
+	sort.Strings(lines)
+	for _, line := range lines {
+		fmt.Fprintf(w, "%s\n", line)
+	}
+	return
+}
+
+func (ai *AdminInfo) kill(w io.Writer, args []string) (err error) {
+	id, err := strconv.Atoi(args[0])
+	if err != nil {
+		return
+	}
+	var d time.Duration
+	if len(args) > 1 {
+		d, err = time.ParseDuration(args[1])
+		if err != nil {
+			return
+		}
+	}
+
+	log.Notice("session %d killed by %s in %s", id, ai.Username, d)
+	err = ai.srv.Kill(id, d)
+	if err != nil {
+		return
+	}
+	if d > 0 {
+		fmt.Fprintf(w, "session %d will be killed in %s.\n", id, d)
+		return
+	}
+	fmt.Fprintf(w, "session %d killed.\n", id)
+	return
+}
+
+func (ai *AdminInfo) msg(w io.Writer, target, msg string) (err error) {
+	id := 0
+	if target != "all" {
+		id, err = strconv.Atoi(target)
+		if err != nil {
+			return
+		}
+	}
+
+	n, err := ai.srv.Broadcast(id, fmt.Sprintf("message from %s: %s", ai.Username, msg))
+	if err != nil {
+		return
+	}
+	fmt.Fprintf(w, "message sent to %d shells.\n", n)
+	return
+}
+
+func (ai *AdminInfo) ban(w io.Writer, args []string) (err error) {
+	if len(args) == 0 {
+		for s, i := range ai.srv.cnt.Items() {
+			fmt.Fprintf(w, "%s\t%d\n", net.IP(s).String(), i)
+		}
+		return
+	}
+
+	ip := net.ParseIP(args[0])
+	if ip == nil {
+		return fmt.Errorf("illegal ip: %s", args[0])
+	}
+	var d time.Duration
+	if len(args) > 1 {
+		d, err = time.ParseDuration(args[1])
+		if err != nil {
+			return
+		}
+	}
+
+	log.Notice("%s banned by %s for %s", ip, ai.Username, d)
+	ai.srv.cnt.AddFor(ipKey(ip), MAX_FAILED+1, d)
+	fmt.Fprintf(w, "%s banned.\n", ip)
+	return
+}
+
+func (ai *AdminInfo) unban(w io.Writer, arg string) (err error) {
+	ip := net.ParseIP(arg)
+	if ip == nil {
+		return fmt.Errorf("illegal ip: %s", arg)
+	}
+	log.Notice("%s unbanned by %s", ip, ai.Username)
+	ai.srv.cnt.Clear(ipKey(ip))
+	fmt.Fprintf(w, "%s unbanned.\n", ip)
+	return
+}
+
+// scanHostKey gets host key of addr, without login.
+func scanHostKey(addr string) (key ssh.PublicKey, err error) {
+	conn, err := net.DialTimeout("tcp", addr, HANDSHAKE_TIMEOUT)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(HANDSHAKE_TIMEOUT))
+
+	config := &ssh.ClientConfig{
+		User: "sshproxy",
+		HostKeyCallback: func(hostname string, remote net.Addr, k ssh.PublicKey) error {
+			key = k
+			// stop here, we got what we want.
+			return ErrHostKey
+		},
+	}
+	_, _, _, err = ssh.NewClientConn(conn, addr, config)
+	if key != nil {
+		err = nil
+	}
+	return
+}
+
+func (ai *AdminInfo) hostkey(w io.Writer, arg string) (err error) {
+	addr, stored := arg, ""
+
+	accounts, err := ai.srv.GetAccounts(ai.Username)
+	if err != nil {
+		return
+	}
+	for _, an := range accounts {
+		if an.Host != arg {
+			continue
+		}
+		var rslt *AccountRslt
+		rslt, err = ai.srv.GetAccount(ai.Username, an.Account, an.Host)
+		if err != nil {
+			return
+		}
+		addr = net.JoinHostPort(rslt.Hostname, strconv.Itoa(rslt.Port))
+		stored = rslt.HostKey
+		break
+	}
+	if _, _, e := net.SplitHostPort(addr); e != nil {
+		addr = net.JoinHostPort(addr, "22")
+	}
+
+	key, err := scanHostKey(addr)
+	if err != nil {
+		return
+	}
+	fmt.Fprintf(w, "%s%s\n", ssh.MarshalAuthorizedKey(key), ssh.FingerprintSHA256(key))
+
+	switch {
+	case stored == "":
+		fmt.Fprintf(w, "not in database.\n")
+	case CheckHostKey(stored)(addr, nil, key) == nil:
+		fmt.Fprintf(w, "match.\n")
+	default:
+		fmt.Fprintf(w, "NOT MATCH.\n")
+	}
+	return
+}
+
+func (ai *AdminInfo) run(w io.Writer, cmd string) (err error) {
+	args := strings.Fields(cmd)
+	if len(args) == 0 {
+		args = []string{"help"}
+	}
+
+	err = ai.srv.InsertAuditLogs(ai.Username, fmt.Sprintf("admin: %s", cmd))
+	if err != nil {
+		return
+	}
+
+	switch {
+	case args[0] == "sessions":
+		return ai.sessions(w)
+	case args[0] == "kill" && (len(args) == 2 || len(args) == 3):
+		return ai.kill(w, args[1:])
+	case args[0] == "msg" && len(args) > 2:
+		return ai.msg(w, args[1], strings.Join(args[2:], " "))
+	case args[0] == "ban":
+		return ai.ban(w, args[1:])
+	case args[0] == "unban" && len(args) == 2:
+		return ai.unban(w, args[1])
+	case args[0] == "reload":
+		err = ai.srv.Reload()
+		if err != nil {
+			return
+		}
+		fmt.Fprintf(w, "reloaded.\n")
+		return
+	case args[0] == "hostkey" && len(args) == 2:
+		return ai.hostkey(w, args[1])
+	case args[0] == "help":
+		io.WriteString(w, ADMIN_USAGE)
+		return
+	}
+	io.WriteString(w, ADMIN_USAGE)
+	return fmt.Errorf("unknown command: %s", cmd)
+}
+
+func (ai *AdminInfo) serveChan(ch ssh.Channel, reqs <-chan *ssh.Request) {
+	defer ch.Close()
+	log.Info("admin chan begin.")
+
+	for req := range reqs {
+		var cmd string
+		switch req.Type {
+		case "exec":
+			strs, err := ReadPayloads(req.Payload)
+			if err != nil || len(strs) == 0 {
+				req.Reply(false, nil)
+				continue
+			}
+			cmd = strs[0]
+		case "shell":
+			cmd = "help"
+		default:
+			if req.WantReply {
+				req.Reply(true, nil)
+			}
+			continue
+		}
+		req.Reply(true, nil)
+
+		log.Notice("admin %s run: %s", ai.Username, cmd)
+		var status [4]byte
+		err := ai.run(ch, cmd)
+		if err != nil {
+			log.Error("%s", err.Error())
+			fmt.Fprintf(ch.Stderr(), "%s\n", err.Error())
+			binary.BigEndian.PutUint32(status[:], 1)
+		}
+		ch.SendRequest("exit-status", false, status[:])
+		break
+	}
+	log.Info("admin chan end.")
+}
+
+func (ai *AdminInfo) Serve(srvConn *ssh.ServerConn, srvChans <-chan ssh.NewChannel, srvReqs <-chan *ssh.Request) (err error) {
+	go ssh.DiscardRequests(srvReqs)
+	log.Info("admin connect begin.")
+
+	for newChan := range srvChans {
+		if newChan.ChannelType() != "session" {
+			newChan.Reject(ssh.ResourceShortage, "not session")
+			continue
+		}
+		ch, reqs, err := newChan.Accept()
+		if err != nil {
+			log.Error("%s", err.Error())
+			continue
+		}
+		go ai.serveChan(ch, reqs)
+	}
+	log.Info("admin connect closed.")
+	return
+}
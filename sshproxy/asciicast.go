@@ -0,0 +1,137 @@
+package sshproxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+	"unicode/utf8"
+)
+
+type AsciicastHeader struct {
+	Version   int               `json:"version"`
+	Width     uint32            `json:"width"`
+	Height    uint32            `json:"height"`
+	Timestamp int64             `json:"timestamp,omitempty"`
+	Title     string            `json:"title,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+}
+
+// utf8Stream holds incomplete utf-8 sequence at the end of chunk,
+// so data split by chunks won't be broken in json.
+type utf8Stream struct {
+	rest []byte
+}
+
+func (us *utf8Stream) decode(p []byte) string {
+	b := append(us.rest, p...)
+	us.rest = nil
+
+	// at most 3 bytes of an incomplete rune.
+	for i := 1; i <= 3 && i <= len(b); i++ {
+		c := b[len(b)-i]
+		if c < 0x80 {
+			break
+		}
+		if utf8.RuneStart(c) {
+			if !utf8.FullRune(b[len(b)-i:]) {
+				us.rest = append([]byte(nil), b[len(b)-i:]...)
+				b = b[:len(b)-i]
+			}
+			break
+		}
+	}
+	return string(b)
+}
+
+// ExportAsciicast converts record file to asciicast v2.
+// Output stream become "o" events, input streams become "i" events,
+// and resize become "r" events. Version 1 has no time, so chunks
+// are paced by QUANTUM_SLICE. Time of events never goes back.
+func ExportAsciicast(r io.Reader, w io.Writer) (err error) {
+	rr, err := CreateRecordReader(r)
+	if err != nil {
+		return
+	}
+	hdr := rr.Header
+
+	ah := &AsciicastHeader{
+		Version: 2,
+		Width:   hdr.Width,
+		Height:  hdr.Height,
+	}
+	if ah.Width == 0 || ah.Height == 0 {
+		ah.Width, ah.Height = 80, 24
+	}
+	if !hdr.Starttime.IsZero() {
+		ah.Timestamp = hdr.Starttime.Unix()
+	}
+	if hdr.Username != "" {
+		ah.Title = fmt.Sprintf("%s: %s@%s", hdr.Username, hdr.Account, hdr.Host)
+	}
+	if hdr.Term != "" {
+		ah.Env = map[string]string{"TERM": hdr.Term}
+	}
+
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	err = enc.Encode(ah)
+	if err != nil {
+		return
+	}
+
+	streams := map[byte]*utf8Stream{
+		REC_INPUT:  &utf8Stream{},
+		REC_OUTPUT: &utf8Stream{},
+		REC_JOIN:   &utf8Stream{},
+	}
+	var last time.Duration
+	for i := 0; ; i++ {
+		var c *Chunk
+		c, err = rr.ReadChunk()
+		// record may be truncated if proxy quit unexpectedly.
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = nil
+			break
+		}
+		if err != nil {
+			return
+		}
+
+		t := c.Time
+		if hdr.Version == 1 {
+			t = QUANTUM_SLICE * time.Duration(i)
+		}
+		// input and output are written by different goroutines, chunks
+		// may be a little out of order, but events must not go back.
+		if t < last {
+			t = last
+		}
+		last = t
+
+		var event []interface{}
+		switch c.Type {
+		case REC_OUTPUT:
+			event = []interface{}{t.Seconds(), "o", streams[c.Type].decode(c.Data)}
+		case REC_INPUT, REC_JOIN:
+			event = []interface{}{t.Seconds(), "i", streams[c.Type].decode(c.Data)}
+		case REC_RESIZE:
+			var width, height uint32
+			width, height, err = parseWindowChange(c.Data)
+			if err != nil {
+				return
+			}
+			event = []interface{}{t.Seconds(), "r", fmt.Sprintf("%dx%d", width, height)}
+		default:
+			continue
+		}
+
+		err = enc.Encode(event)
+		if err != nil {
+			return
+		}
+	}
+
+	return bw.Flush()
+}
@@ -0,0 +1,111 @@
+package sshproxy
+
+import (
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+type UserInfo struct {
+	Username string
+	// bcrypt hash of password
+	Password string
+	// rules of user, such as admin and audit
+	Perms []string
+	// publickey, password and keyboard-interactive, empty means publickey only.
+	AuthMethods []string
+	// base32 secret of totp, empty means not enrolled.
+	TotpSecret string
+}
+
+func (ui *UserInfo) ChkRule(rule string) bool {
+	for _, r := range ui.Perms {
+		if r == rule {
+			return true
+		}
+	}
+	return false
+}
+
+func (ui *UserInfo) ChkAuthMethod(method string) bool {
+	if len(ui.AuthMethods) == 0 {
+		return method == "publickey"
+	}
+	for _, m := range ui.AuthMethods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// HopInfo is a jump host on the way to target.
+type HopInfo struct {
+	AccountInfo
+	// command run on this hop to reach the next one,
+	// empty means direct-tcpip.
+	ProxyCommand string
+}
+
+type AccountRslt struct {
+	AccountInfo
+	// jump hosts, the first one is dialed directly.
+	Hops  []*HopInfo
+	Perms []string
+	// rules on commands, from groups between user and account.
+	CmdRules []*CmdRule
+	// rules on content of files transferred, from the same groups.
+	DlpRules []*DlpRule
+	// patterns of exec command line, from the same groups.
+	// Empty allow means any command not denied.
+	ExecAllow []string
+	ExecDeny  []string
+	// capture mode of transferred files, hash or full, empty for none.
+	// CaptureMax is the max size to store in full mode, 0 for no limit.
+	Capture    string
+	CaptureMax int
+	// largest file and total bytes of scp in a session, 0 for no limit.
+	ScpMaxFile int
+	ScpQuota   int
+	// rate limits of channel classes, lines like "scp 1m".
+	RateLimits []string
+}
+
+// AccountName is an account on host which user can connect to.
+type AccountName struct {
+	Account string
+	Host    string
+}
+
+func (an *AccountName) String() string {
+	return an.Account + "@" + an.Host
+}
+
+// Backend is where the proxy gets config, users, accounts and permissions,
+// and where it writes records back to.
+type Backend interface {
+	// GetConfig returns listen address, hostkey and log dir.
+	GetConfig() (cfg *WebConfig, err error)
+	// GetUser returns user with password hash, rules and auth methods.
+	GetUser(username string) (user *UserInfo, err error)
+	// FindPubkey returns the username who owns the pubkey.
+	FindPubkey(key ssh.PublicKey) (username string, err error)
+	// GetAccount resolves account@host, hops to it,
+	// and the perms username has on it.
+	GetAccount(username, account, host string) (rslt *AccountRslt, err error)
+	// GetAccounts lists accounts username has any perms on.
+	GetAccounts(username string) (accounts []*AccountName, err error)
+	// InsertRecord creates a record for a new connection.
+	InsertRecord(username, account, host string) (recordid int, starttime time.Time, err error)
+	// UpdateEndtime closes the record.
+	UpdateEndtime(recordid int) (err error)
+	// InsertRecordLogs adds a channel log to the record.
+	InsertRecordLogs(recordid int, rltype, log1, log2 string, num1 int) (id int, err error)
+	// UpdateRecordLogsHash sets sha256 of file transferred in recordlog.
+	UpdateRecordLogsHash(recordlogid int, hash string) (err error)
+	// InsertAuditLogs writes what username did into auditlogs.
+	InsertAuditLogs(username, l string) (err error)
+	// CheckReview tells whether username can review the recordlog,
+	// and the starttime of its record. Access should be audited.
+	CheckReview(username string, recordlogid int) (access bool, starttime time.Time, err error)
+}
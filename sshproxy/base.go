@@ -7,6 +7,7 @@ import (
 	"io"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/op/go-logging"
@@ -17,18 +18,47 @@ var (
 	ErrDataBase             = errors.New("database error")
 	ErrScpStreamIllegal     = errors.New("scp stream illegal")
 	ErrChanTypeNotSupported = errors.New("channel type not support")
+	ErrChanSetup            = errors.New("channel already set up")
 	ErrIllegalUserName      = errors.New("illegal username")
 	ErrIllegalPubkey        = errors.New("illegal pubkey")
 	ErrSCSNotFound          = errors.New("ssh conn server not found")
 	ErrHostKey              = errors.New("host key not match")
 	ErrNoPerms              = errors.New("no perms")
 	ErrFailedTooMany        = errors.New("banned because failed too many times")
+	ErrUserNotExist         = errors.New("user not exist")
+	ErrAccountNotExist      = errors.New("account not exist")
+	ErrRecordNotExist       = errors.New("record not exist")
+	ErrAuthMethod           = errors.New("auth method not allowed")
+	ErrPasswordNotMatch     = errors.New("password not match")
+	ErrTotpNotMatch         = errors.New("totp code not match")
+	ErrCertIllegal          = errors.New("illegal certificate")
+	ErrRevokedKeysIllegal   = errors.New("illegal revoked keys")
+	ErrTooManyHops          = errors.New("too many hops")
+	ErrPayloadIllegal       = errors.New("illegal payload")
+	ErrForwardNotFound      = errors.New("remote forward not found")
+	ErrLiveNotFound         = errors.New("live session not found")
+	ErrNotApproved          = errors.New("session not approved")
+	ErrSessionNotFound      = errors.New("session not found")
+	ErrCmdBlocked           = errors.New("command blocked by rule")
+	ErrCmdTooLong           = errors.New("command line too long")
+	ErrSftpIllegal          = errors.New("illegal sftp packet")
+	ErrDlpAbort             = errors.New("transfer aborted by dlp rule")
 )
 
 var (
-	CONN_PROTECT  = 300 * time.Second
-	MAX_FAILED    = 3
-	QUANTUM_SLICE = 200 * time.Millisecond
+	CONN_PROTECT      = 300 * time.Second
+	MAX_FAILED        = 3
+	QUANTUM_SLICE     = 200 * time.Millisecond
+	TOTP_PERIOD       = 30 * time.Second
+	TOTP_DIGITS       = 6
+	TOTP_SKEW         = 1
+	CERT_VALID        = 5 * time.Minute
+	MAX_HOPS          = 8
+	HANDSHAKE_TIMEOUT = 30 * time.Second
+	REVIEW_SEEK       = 5 * time.Second
+	APPROVE_TIMEOUT   = 5 * time.Minute
+	SFTP_MAX_PACKET   = uint32(1 << 20)
+	CMD_MAX_LINE      = 64 * 1024
 )
 
 var log = logging.MustGetLogger("")
@@ -85,13 +115,22 @@ func MultiCopyClose(s io.Reader, ds ...io.WriteCloser) (err error) {
 }
 
 func ReadPayloadString(payload []byte) (s string, rest []byte, err error) {
+	if len(payload) < 4 {
+		return "", nil, ErrPayloadIllegal
+	}
 	size := binary.BigEndian.Uint32(payload[:4])
+	if uint32(len(payload)-4) < size {
+		return "", nil, ErrPayloadIllegal
+	}
 	s = string(payload[4 : 4+size])
 	rest = payload[4+size:]
 	return
 }
 
 func ReadPayloadUint32(payload []byte) (i uint32, rest []byte, err error) {
+	if len(payload) < 4 {
+		return 0, nil, ErrPayloadIllegal
+	}
 	i = binary.BigEndian.Uint32(payload[:4])
 	rest = payload[4:]
 	return
@@ -109,6 +148,24 @@ func ReadPayloads(payload []byte) (strs []string, err error) {
 	return
 }
 
+func parsePtyReq(d []byte) (term string, width, height uint32, err error) {
+	term, d, err = ReadPayloadString(d)
+	if err != nil {
+		return
+	}
+	width, height, err = parseWindowChange(d)
+	return
+}
+
+func parseWindowChange(d []byte) (width, height uint32, err error) {
+	width, d, err = ReadPayloadUint32(d)
+	if err != nil {
+		return
+	}
+	height, d, err = ReadPayloadUint32(d)
+	return
+}
+
 func getTcpInfo(d []byte) (srcip string, srcport uint32, dstip string, dstport uint32, err error) {
 	srcip, d, err = ReadPayloadString(d)
 	if err != nil {
@@ -142,6 +199,28 @@ func (ds *DebugStream) Close() error {
 	return nil
 }
 
+// ByteCounter counts bytes written to it, and adds them to up if set.
+type ByteCounter struct {
+	n  int64
+	up *ByteCounter
+}
+
+func (bc *ByteCounter) Write(p []byte) (n int, err error) {
+	atomic.AddInt64(&bc.n, int64(len(p)))
+	if bc.up != nil {
+		bc.up.Write(p)
+	}
+	return len(p), nil
+}
+
+func (bc *ByteCounter) Close() error {
+	return nil
+}
+
+func (bc *ByteCounter) Count() int64 {
+	return atomic.LoadInt64(&bc.n)
+}
+
 type SshConnServer interface {
 	Serve(*ssh.ServerConn, <-chan ssh.NewChannel, <-chan *ssh.Request) error
 }
@@ -160,6 +239,11 @@ func CreateCounter(d time.Duration) (c *Counter) {
 }
 
 func (c *Counter) Add(s string, n int) {
+	c.AddFor(s, n, c.d)
+}
+
+// AddFor adds n to s for d, forever if d is 0.
+func (c *Counter) AddFor(s string, n int, d time.Duration) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	i, ok := c.cm[s]
@@ -168,7 +252,26 @@ func (c *Counter) Add(s string, n int) {
 	}
 	i += n
 	c.cm[s] = i
-	time.AfterFunc(c.d, func() { c.Remove(s, n) })
+	if d > 0 {
+		time.AfterFunc(d, func() { c.Remove(s, n) })
+	}
+}
+
+func (c *Counter) Clear(s string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.cm, s)
+}
+
+// Items returns a copy of all counts.
+func (c *Counter) Items() (items map[string]int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	items = make(map[string]int, len(c.cm))
+	for s, i := range c.cm {
+		items[s] = i
+	}
+	return
 }
 
 func (c *Counter) Remove(s string, n int) {
@@ -205,6 +308,8 @@ type AccountInfo struct {
 	Account   string
 	Key       string
 	Password  string
+	// channels on sensitive host need approval of another user.
+	Sensitive bool
 }
 
 func (ai *AccountInfo) ClientConfig() (config *ssh.ClientConfig, err error) {
@@ -0,0 +1,216 @@
+package sshproxy
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"io/ioutil"
+	"net"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// UserCertChecker accepts OpenSSH user certificates signed by CA keys,
+// principals in certificate are usernames of proxy.
+type UserCertChecker struct {
+	ssh.CertChecker
+	cas []ssh.PublicKey
+	// path of KRL or revoked list, read every time so it can be updated.
+	revoked string
+}
+
+func CreateUserCertChecker(userca, revoked string) (ucc *UserCertChecker, err error) {
+	ucc = &UserCertChecker{revoked: revoked}
+
+	rest := []byte(userca)
+	for len(bytes.TrimSpace(rest)) > 0 {
+		var ca ssh.PublicKey
+		ca, _, _, rest, err = ssh.ParseAuthorizedKey(rest)
+		if err != nil {
+			log.Error("failed to parse user ca: %s", err.Error())
+			return
+		}
+		ucc.cas = append(ucc.cas, ca)
+	}
+	log.Info("%d user ca loaded.", len(ucc.cas))
+
+	ucc.CertChecker.IsUserAuthority = ucc.isUserAuthority
+	ucc.CertChecker.IsRevoked = func(cert *ssh.Certificate) bool {
+		return ucc.IsRevoked(cert)
+	}
+	return
+}
+
+func (ucc *UserCertChecker) isUserAuthority(auth ssh.PublicKey) bool {
+	b := auth.Marshal()
+	for _, ca := range ucc.cas {
+		if bytes.Equal(b, ca.Marshal()) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsRevoked checks key against revoked file, fail closed if it can't be read.
+func (ucc *UserCertChecker) IsRevoked(key ssh.PublicKey) bool {
+	if ucc.revoked == "" {
+		return false
+	}
+
+	data, err := ioutil.ReadFile(ucc.revoked)
+	if err != nil {
+		log.Error("%s", err.Error())
+		return true
+	}
+	rk, err := ParseRevokedKeys(data)
+	if err != nil {
+		return true
+	}
+	if rk.IsRevoked(key) {
+		log.Warning("key revoked: %s", ssh.FingerprintSHA256(key))
+		return true
+	}
+	return false
+}
+
+// CheckUserCert returns username from certificate. name comes from login name,
+// if it's empty, certificate should have only one principal.
+func (ucc *UserCertChecker) CheckUserCert(meta ssh.ConnMetadata, cert *ssh.Certificate, name string) (username string, err error) {
+	if cert.CertType != ssh.UserCert {
+		err = ErrCertIllegal
+		log.Error("%s: not user cert", err.Error())
+		return
+	}
+	if !ucc.isUserAuthority(cert.SignatureKey) {
+		err = ErrCertIllegal
+		log.Error("%s: ca not trusted", err.Error())
+		return
+	}
+
+	username = name
+	if username == "" {
+		if len(cert.ValidPrincipals) != 1 {
+			err = ErrIllegalUserName
+			log.Error("%s: cert have principals %v", err.Error(), cert.ValidPrincipals)
+			return
+		}
+		username = cert.ValidPrincipals[0]
+	}
+
+	// empty principals means valid for all users, that's too dangerous here.
+	if len(cert.ValidPrincipals) == 0 {
+		err = ErrCertIllegal
+		log.Error("%s: no principal", err.Error())
+		return
+	}
+
+	err = ucc.CheckCert(username, cert)
+	if err != nil {
+		log.Error("%s", err.Error())
+		return
+	}
+
+	if sa, ok := cert.CriticalOptions["source-address"]; ok {
+		err = checkSourceAddress(meta.RemoteAddr(), sa)
+		if err != nil {
+			return
+		}
+	}
+
+	log.Info("cert %s (serial %d) accepted as %s.", cert.KeyId, cert.Serial, username)
+	return
+}
+
+func checkSourceAddress(addr net.Addr, sourceAddrs string) (err error) {
+	taddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		err = ErrCertIllegal
+		log.Error("%s: remote not tcp", err.Error())
+		return
+	}
+
+	for _, sa := range strings.Split(sourceAddrs, ",") {
+		sa = strings.TrimSpace(sa)
+		if ip := net.ParseIP(sa); ip != nil {
+			if ip.Equal(taddr.IP) {
+				return nil
+			}
+			continue
+		}
+
+		_, ipnet, err := net.ParseCIDR(sa)
+		if err != nil {
+			log.Error("%s", err.Error())
+			return ErrCertIllegal
+		}
+		if ipnet.Contains(taddr.IP) {
+			return nil
+		}
+	}
+
+	err = ErrCertIllegal
+	log.Error("%s: %s not in source-address %s", err.Error(), taddr.IP, sourceAddrs)
+	return
+}
+
+// AccountCA signs short-lived user certificates for accounts on target hosts,
+// so hosts only need to trust the CA.
+type AccountCA struct {
+	signer ssh.Signer
+}
+
+func CreateAccountCA(private string) (ac *AccountCA, err error) {
+	signer, err := ssh.ParsePrivateKey([]byte(private))
+	if err != nil {
+		log.Error("failed to parse account ca: %s", err.Error())
+		return
+	}
+	return &AccountCA{signer: signer}, nil
+}
+
+// CreateCertSigner generates a new key, and signs it for principal,
+// valid in CERT_VALID.
+func (ac *AccountCA) CreateCertSigner(principal, keyid string, serial uint64) (signer ssh.Signer, err error) {
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		log.Error("%s", err.Error())
+		return
+	}
+	key, err := ssh.NewSignerFromKey(private)
+	if err != nil {
+		log.Error("%s", err.Error())
+		return
+	}
+
+	now := time.Now()
+	cert := &ssh.Certificate{
+		Key:             key.PublicKey(),
+		Serial:          serial,
+		CertType:        ssh.UserCert,
+		KeyId:           keyid,
+		ValidPrincipals: []string{principal},
+		// in case clock of target host is a little slow.
+		ValidAfter:  uint64(now.Add(-time.Minute).Unix()),
+		ValidBefore: uint64(now.Add(CERT_VALID).Unix()),
+		Permissions: ssh.Permissions{
+			Extensions: map[string]string{
+				"permit-X11-forwarding":   "",
+				"permit-agent-forwarding": "",
+				"permit-port-forwarding":  "",
+				"permit-pty":              "",
+				"permit-user-rc":          "",
+			},
+		},
+	}
+	err = cert.SignCert(rand.Reader, ac.signer)
+	if err != nil {
+		log.Error("%s", err.Error())
+		return
+	}
+	log.Info("cert %s signed for %s, valid before %s.",
+		keyid, principal, now.Add(CERT_VALID).Format(time.RFC3339))
+
+	return ssh.NewCertSigner(cert, key)
+}
@@ -2,49 +2,54 @@ package sshproxy
 
 import (
 	"fmt"
-	"net/url"
+	"io"
 	"strings"
+	"sync"
+	"time"
 
 	"golang.org/x/crypto/ssh"
 )
 
 type ChanInfo struct {
 	ci           *ConnInfo
+	user         ssh.Channel
+	mu           sync.Mutex
+	wg           sync.WaitGroup
+	logger       *Logger
+	tap          *LiveTap
+	ap           *Approval
+	replied      map[*ssh.Request]bool
+	ev           *Evidence
+	dlp          *DlpScanner
+	file         string
 	RecordLogsId int
 	ch           chan int
+	set          bool
 	Type         string
 	RemoteDir    string
 	ExecCmds     []string
+	Term         string
+	Width        uint32
+	Height       uint32
+	Starttime    time.Time
+	// bytes from user, and bytes to user.
+	In  ByteCounter
+	Out ByteCounter
 }
 
 func CreateChanInfo(ci *ConnInfo) (chi *ChanInfo) {
 	chi = &ChanInfo{
-		ci:   ci,
-		ch:   make(chan int, 1),
-		Type: "unknown",
+		ci:        ci,
+		ch:        make(chan int, 1),
+		Type:      "unknown",
+		Starttime: time.Now(),
 	}
+	chi.In.up, chi.Out.up = &ci.In, &ci.Out
 	return chi
 }
 
 func (chi *ChanInfo) insertRecordLogs(rltype, log1, log2 string, num1 int) (id int, err error) {
-	v := &url.Values{}
-	v.Add("recordid", fmt.Sprintf("%d", chi.ci.RecordId))
-	v.Add("type", rltype)
-	v.Add("log1", log1)
-	v.Add("log2", log2)
-	v.Add("num1", fmt.Sprintf("%d", num1))
-
-	type RecordLogsRslt struct {
-		Id int
-	}
-	rslt := &RecordLogsRslt{}
-
-	err = chi.ci.srv.GetJson("/l/rlog", true, v, rslt)
-	if err != nil {
-		return
-	}
-	id = rslt.Id
-	return
+	return chi.ci.srv.InsertRecordLogs(chi.ci.RecordId, rltype, log1, log2, num1)
 }
 
 func (chi *ChanInfo) TcpForward(direct, ip string, port uint32) (err error) {
@@ -53,19 +58,104 @@ func (chi *ChanInfo) TcpForward(direct, ip string, port uint32) (err error) {
 	return
 }
 
-func (chi *ChanInfo) FileTransmit(filename string, size int) (err error) {
-	log.Notice("%s with name: %s, size: %d, remote dir: %s",
-		chi.Type, filename, size, chi.RemoteDir)
-	chi.RecordLogsId, err = chi.insertRecordLogs(chi.Type, filename, chi.RemoteDir, size)
+// FileCheck checks file against limits of session, refusal is recorded.
+func (chi *ChanInfo) FileCheck(sf *ScpFile) (reason string, err error) {
+	reason = chi.ci.reserveScp(sf.Size)
+	if reason == "" {
+		return
+	}
+	log.Warning("%s %s refused: %s", chi.Type, sf.Path, reason)
+	_, err = chi.insertRecordLogs("refuse", chi.Type+" "+sf.Path, reason, sf.Size)
+	return
+}
+
+func (chi *ChanInfo) FileTransmit(sf *ScpFile) (err error) {
+	log.Notice("%s with name: %s, size: %d, mode: %04o, mtime: %s, remote dir: %s",
+		chi.Type, sf.Path, sf.Size, sf.Mode, sf.Mtime, chi.RemoteDir)
+	chi.RecordLogsId, err = chi.insertRecordLogs(chi.Type, sf.Path, chi.RemoteDir, sf.Size)
+	if err != nil {
+		return
+	}
+
+	chi.file = sf.Path
+	if len(chi.ci.DlpRules) != 0 {
+		chi.dlp = CreateDlpScanner(chi.ci.DlpRules)
+	}
+
+	if chi.ci.Capture == "" {
+		return
+	}
+	chi.ev, err = CreateEvidence(chi.ci.srv.WebConfig.Logdir, chi.ci.Capture, chi.ci.CaptureMax)
 	return
 }
 
 func (chi *ChanInfo) FileData(b []byte) (err error) {
+	if chi.ev != nil {
+		_, err = chi.ev.Write(b)
+		if err != nil {
+			return
+		}
+	}
+	if chi.dlp != nil {
+		err = chi.checkDlp(b)
+	}
 	return
 }
 
+// FileEnd writes hash of captured file into its recordlog.
+func (chi *ChanInfo) FileEnd() (err error) {
+	ev := chi.ev
+	chi.ev, chi.dlp = nil, nil
+	if ev == nil {
+		return
+	}
+
+	sum, stored, err := ev.Finish()
+	if err != nil {
+		return
+	}
+	log.Notice("%s captured, sha256: %s, size: %d, stored: %t", chi.Type, sum, ev.Size, stored)
+	return chi.ci.srv.UpdateRecordLogsHash(chi.RecordLogsId, sum)
+}
+
+// refuse tells user why cmd is refused.
+func (chi *ChanInfo) refuse(cmd, reason string) {
+	log.Error("exec %s refused: %s", cmd, reason)
+	fmt.Fprintf(chi.user.Stderr(), "%s: %s\r\n", cmd, reason)
+}
+
+// setup tells Serve the channel is ready, or refused if err is not nil.
+// It happens only once, so it's safe to call again.
+func (chi *ChanInfo) setup(err error) error {
+	chi.mu.Lock()
+	defer chi.mu.Unlock()
+	if chi.set {
+		return err
+	}
+	chi.set = true
+	if err == nil {
+		chi.ch <- 1
+	}
+	close(chi.ch)
+	return err
+}
+
+func (chi *ChanInfo) isSet() bool {
+	chi.mu.Lock()
+	defer chi.mu.Unlock()
+	return chi.set
+}
+
 func (chi *ChanInfo) onReq(req *ssh.Request) (err error) {
 	var strs []string
+	switch req.Type {
+	case "exec", "shell", "subsystem":
+		// channel is set up, or refused, by the first of them.
+		if chi.isSet() {
+			return ErrChanSetup
+		}
+	}
+
 	switch req.Type {
 	case "env":
 		strs, err = ReadPayloads(req.Payload)
@@ -80,43 +170,98 @@ func (chi *ChanInfo) onReq(req *ssh.Request) (err error) {
 		if err != nil {
 			return
 		}
+		if len(strs) == 0 {
+			return ErrPayloadIllegal
+		}
 
 		log.Debug("exec with cmd: %s.", strs[0])
-		cmds := strings.Split(strs[0], " ")
-
-		switch cmds[0] {
-		case "scp":
-			switch cmds[len(cmds)-2] {
-			case "-t":
-				chi.Type = "scpto"
-				if !chi.ci.ChkPerm("scpto") {
-					close(chi.ch)
-					return ErrNoPerms
-				}
-			case "-f":
-				chi.Type = "scpfrom"
-				if !chi.ci.ChkPerm("scpfrom") {
-					close(chi.ch)
-					return ErrNoPerms
-				}
+		sc := ParseScpCmd(strs[0])
+
+		switch {
+		case sc != nil:
+			chi.Type = sc.Mode
+			if !chi.ci.ChkPerm(sc.Mode) {
+				return chi.setup(ErrNoPerms)
 			}
-			chi.ch <- 1
-			chi.RemoteDir = cmds[len(cmds)-1]
-			log.Info("session in %s mode, remote dir: %s.",
-				chi.Type, chi.RemoteDir)
+			chi.RemoteDir = sc.Target
+			err = chi.waitApproval(sc.Target)
+			if err != nil {
+				return chi.setup(err)
+			}
+			// target runs what we parsed, not what user sent.
+			req.Payload = ssh.Marshal(struct{ Command string }{sc.String()})
+			chi.setup(nil)
+			log.Info("session in %s mode, remote dir: %s, recursive: %t.",
+				chi.Type, chi.RemoteDir, sc.Recursive)
 		default:
 			chi.Type = "exec"
-			chi.ch <- 1
+			reason := chi.ci.chkExec(strs[0])
+			if reason != "" {
+				chi.refuse(strs[0], reason)
+				chi.setup(ErrNoPerms)
+				_, err = chi.insertRecordLogs("refuse", strs[0], reason, 0)
+				if err != nil {
+					return
+				}
+				return ErrNoPerms
+			}
+			// rules hit by cmd are recorded under it.
+			chi.RecordLogsId, err = chi.insertRecordLogs(chi.Type, strs[0], "", 0)
+			if err != nil {
+				return
+			}
+			rule := chi.checkCmd(strs[0])
+			if rule != nil && rule.Action != CMD_WARN {
+				chi.refuse(strs[0], "command not allowed")
+				return chi.setup(ErrCmdBlocked)
+			}
+			err = chi.waitApproval(strs[0])
+			if err != nil {
+				return chi.setup(err)
+			}
+			chi.setup(nil)
 			chi.ExecCmds = append(chi.ExecCmds, strs[0])
 		}
 	case "shell":
 		if !chi.ci.ChkPerm("shell") {
-			close(chi.ch)
-			return ErrNoPerms
+			return chi.setup(ErrNoPerms)
 		}
 		chi.Type = "shell"
-		chi.ch <- 1
+		err = chi.createApproval("")
+		if err != nil {
+			return chi.setup(err)
+		}
+		chi.setup(nil)
 		log.Info("session in shell mode")
+
+		// input is read in holding, so ctrl-c aborts.
+		err = chi.hold()
+		if err != nil {
+			chi.user.Close()
+			return
+		}
+	case "subsystem":
+		strs, err = ReadPayloads(req.Payload)
+		if err != nil {
+			return
+		}
+		if len(strs) == 0 {
+			return ErrPayloadIllegal
+		}
+		if strs[0] != "sftp" {
+			log.Debug("subsystem: %s", strs[0])
+			break
+		}
+		if !chi.ci.ChkPerm("sftp") {
+			return chi.setup(ErrNoPerms)
+		}
+		chi.Type = "sftp"
+		err = chi.waitApproval("")
+		if err != nil {
+			return chi.setup(err)
+		}
+		chi.setup(nil)
+		log.Info("session in sftp mode")
 	case "x11-req":
 		strs, err = ReadPayloads(req.Payload[1:])
 		if err != nil {
@@ -125,7 +270,38 @@ func (chi *ChanInfo) onReq(req *ssh.Request) (err error) {
 		for _, env := range strs {
 			log.Debug("x11: %s", env)
 		}
-	case "pty-req", "keepalive@openssh.com", "auth-agent-req@openssh.com":
+	case "pty-req":
+		var term string
+		var width, height uint32
+		term, width, height, err = parsePtyReq(req.Payload)
+		if err != nil {
+			return
+		}
+		log.Debug("pty: %s %dx%d", term, width, height)
+
+		chi.mu.Lock()
+		chi.Term, chi.Width, chi.Height = term, width, height
+		chi.mu.Unlock()
+	case "window-change":
+		var width, height uint32
+		width, height, err = parseWindowChange(req.Payload)
+		if err != nil {
+			return
+		}
+
+		chi.mu.Lock()
+		chi.Width, chi.Height = width, height
+		l := chi.logger
+		chi.mu.Unlock()
+
+		if l != nil {
+			// failure of recording should not stop resize of target.
+			e := l.WriteResize(width, height)
+			if e != nil {
+				log.Error("%s", e.Error())
+			}
+		}
+	case "keepalive@openssh.com", "auth-agent-req@openssh.com":
 	default:
 		log.Debug("%v", req.Payload)
 	}
@@ -137,13 +313,10 @@ func (chi *ChanInfo) onType(chantype string, extra []byte) (err error) {
 	case "session":
 	case "direct-tcpip":
 		if !chi.ci.ChkPerm("tcp") {
-			close(chi.ch)
-			return ErrNoPerms
+			return chi.setup(ErrNoPerms)
 		}
 
 		chi.Type = "local"
-		chi.ch <- 1
-
 		ip, port, _, _, err := getTcpInfo(extra)
 		if err != nil {
 			return err
@@ -153,32 +326,51 @@ func (chi *ChanInfo) onType(chantype string, extra []byte) (err error) {
 		if err != nil {
 			return err
 		}
+		err = chi.waitApproval(ip)
+		if err != nil {
+			return err
+		}
+		chi.setup(nil)
 	case "forwarded-tcpip":
-		if !chi.ci.ChkPerm("tcp") {
-			close(chi.ch)
-			return ErrNoPerms
+		if !chi.ci.ChkPerm("remoteforward") {
+			return chi.setup(ErrNoPerms)
 		}
 
-		chi.Type = "remote"
-		chi.ch <- 1
+		addr, port, ip, srcport, err := getTcpInfo(extra)
+		if err != nil {
+			return chi.setup(err)
+		}
 
-		ip, port, _, _, err := getTcpInfo(extra)
+		rf := chi.ci.getRemoteForward(addr, port)
+		if rf == nil {
+			chi.setup(ErrForwardNotFound)
+			log.Error("%s: %s:%d", ErrForwardNotFound.Error(), addr, port)
+			return ErrForwardNotFound
+		}
+
+		chi.Type = "remote"
+		log.Notice("remote forward %s from %s:%d", rf.String(), ip, srcport)
+		chi.RecordLogsId, err = chi.insertRecordLogs(
+			chi.Type, ip, rf.String(), int(srcport))
 		if err != nil {
 			return err
 		}
-
-		err = chi.TcpForward("remote", ip, port)
+		err = chi.waitApproval(ip)
 		if err != nil {
 			return err
 		}
+		chi.setup(nil)
 	case "auth-agent@openssh.com":
 		if !chi.ci.ChkPerm("tcp") {
-			close(chi.ch)
-			return ErrNoPerms
+			return chi.setup(ErrNoPerms)
 		}
 
 		chi.Type = "sshagent"
-		chi.ch <- 1
+		err = chi.waitApproval("")
+		if err != nil {
+			return chi.setup(err)
+		}
+		chi.setup(nil)
 	default:
 		log.Error("channel type %s not supported.", chantype)
 		err = ErrChanTypeNotSupported
@@ -186,23 +378,60 @@ func (chi *ChanInfo) onType(chantype string, extra []byte) (err error) {
 	return
 }
 
+// prepareFile creates recordlog if not yet, and record file of it.
 func (chi *ChanInfo) prepareFile(cmd string) (l *Logger, err error) {
-	chi.RecordLogsId, err = chi.insertRecordLogs(chi.Type, cmd, "", 0)
+	if chi.RecordLogsId == 0 {
+		chi.RecordLogsId, err = chi.insertRecordLogs(chi.Type, cmd, "", 0)
+		if err != nil {
+			return
+		}
+	}
+
+	chi.mu.Lock()
+	defer chi.mu.Unlock()
+	hdr := &RecordHeader{
+		RecordId:     chi.ci.RecordId,
+		RecordLogsId: chi.RecordLogsId,
+		Username:     chi.ci.Username,
+		Account:      chi.ci.Account,
+		Host:         chi.ci.Host,
+		Type:         chi.Type,
+		Cmd:          cmd,
+		Term:         chi.Term,
+		Width:        chi.Width,
+		Height:       chi.Height,
+	}
+	l, err = CreateLogger(chi.ci.srv.WebConfig.Logdir, chi.ci.Starttime, chi.RecordLogsId, hdr)
 	if err != nil {
 		return
 	}
-	return CreateLogger(chi.ci.srv.WebConfig.Logdir, chi.ci.Starttime, chi.RecordLogsId)
+	chi.logger = l
+	return
+}
+
+// failReplied tells user req replied true by menu, before target chosen,
+// failed at last. Channel is closed if shell failed.
+func (chi *ChanInfo) failReplied(req *ssh.Request) {
+	log.Error("%s replied by menu failed", req.Type)
+	fmt.Fprintf(chi.user.Stderr(), "%s request failed.\r\n", req.Type)
+	if req.Type == "shell" {
+		chi.user.Close()
+	}
 }
 
 func (chi *ChanInfo) serveReq(ch ssh.Channel, req *ssh.Request) (err error) {
+	replied := chi.replied[req]
 	err = chi.onReq(req)
 	if err != nil {
 		log.Error("%s", err.Error())
 		req.Reply(false, nil)
+		if replied {
+			chi.failReplied(req)
+		}
 		return
 	}
 
-	r, err := ch.SendRequest(req.Type, req.WantReply, req.Payload)
+	r, err := ch.SendRequest(req.Type, req.WantReply || replied, req.Payload)
 	if err != nil {
 		log.Error("%s", err.Error())
 		req.Reply(false, nil)
@@ -210,6 +439,11 @@ func (chi *ChanInfo) serveReq(ch ssh.Channel, req *ssh.Request) (err error) {
 	}
 	log.Debug("send chan req ok: %s(result: %t)", req.Type, r)
 
+	if replied && !r {
+		chi.failReplied(req)
+		return
+	}
+
 	err = req.Reply(r, nil)
 	if err != nil {
 		return
@@ -219,6 +453,7 @@ func (chi *ChanInfo) serveReq(ch ssh.Channel, req *ssh.Request) (err error) {
 }
 
 func (ci *ChanInfo) serveReqs(ch ssh.Channel, reqs <-chan *ssh.Request) {
+	defer ci.wg.Done()
 	defer ch.Close()
 	log.Debug("chan reqs begin.")
 	for req := range reqs {
@@ -258,42 +493,80 @@ func (chi *ChanInfo) Serve(conn ssh.Conn, newChan ssh.NewChannel) (err error) {
 		return
 	}
 	log.Debug("accept channel ok.")
+	chi.user = chin
+	if ac, ok := newChan.(*acceptedChannel); ok {
+		chi.replied = ac.replied
+	}
 
+	// channel is active until requests of both sides end.
+	chi.ci.addChan(chi)
+	chi.wg.Add(2)
 	go chi.serveReqs(chin, outreqs)
 	go chi.serveReqs(chout, inreqs)
+	go func() {
+		chi.wg.Wait()
+		chi.ci.removeChan(chi)
+	}()
 
 	_, ok := <-chi.ch
 	if !ok {
 		return
 	}
 
+	th := chi.throttle()
 	switch chi.Type {
 	case "local", "remote":
-		go MultiCopyClose(chin, chout, &DebugStream{"out"})
-		go MultiCopyClose(chout, chin, &DebugStream{"in"})
+		go MultiCopyClose(chin, th, chout, &DebugStream{"out"}, &chi.In)
+		go MultiCopyClose(chout, th, chin, &DebugStream{"in"}, &chi.Out)
 	case "sshagent":
-		go MultiCopyClose(chin, chout, &DebugStream{"out"})
-		go MultiCopyClose(chout, chin, &DebugStream{"in"})
+		go MultiCopyClose(chin, th, chout, &DebugStream{"out"}, &chi.In)
+		go MultiCopyClose(chout, th, chin, &DebugStream{"in"}, &chi.Out)
 	case "shell":
 		l, err := chi.prepareFile("")
 		if err != nil {
 			return err
 		}
-		go MultiCopyClose(chin, chout, l.CreateSubLogger(byte(0x01)))
-		go MultiCopyClose(chout, chin, l.CreateSubLogger(byte(0x02)))
+		tap := CreateLiveTap(chi, chin, chout, l)
+		chi.mu.Lock()
+		chi.tap = tap
+		chi.mu.Unlock()
+		var in io.Reader = chin
+		if chi.ap != nil {
+			in = &holdReader{ap: chi.ap, r: chin}
+		}
+		cf := CreateCmdFilter(chi, in, chin.Stderr(), chi.Term != "")
+		go MultiCopyClose(cf, th, chout, l.CreateSubLogger(REC_INPUT), &chi.In)
+		go MultiCopyClose(chout, th, chin, l.CreateSubLogger(REC_OUTPUT), cf.Echo(), tap, &chi.Out)
 	case "exec":
 		l, err := chi.prepareFile(strings.Join(chi.ExecCmds, "\r"))
 		if err != nil {
 			return err
 		}
-		go MultiCopyClose(chin, chout, l.CreateSubLogger(byte(0x01)))
-		go MultiCopyClose(chout, chin, l.CreateSubLogger(byte(0x02)))
+		// without pty, input is data of cmd, not command lines.
+		if chi.Term == "" {
+			go MultiCopyClose(chin, th, chout, l.CreateSubLogger(REC_INPUT), &chi.In)
+			go MultiCopyClose(chout, th, chin, l.CreateSubLogger(REC_OUTPUT), &chi.Out)
+			break
+		}
+		cf := CreateCmdFilter(chi, chin, chin.Stderr(), true)
+		go MultiCopyClose(cf, th, chout, l.CreateSubLogger(REC_INPUT), &chi.In)
+		go MultiCopyClose(chout, th, chin, l.CreateSubLogger(REC_OUTPUT), &chi.Out, cf.Echo())
 	case "scpto":
-		go MultiCopyClose(chin, chout, CreateScpStream(chi))
-		go MultiCopyClose(chout, chin)
+		go MultiCopyClose(CreateScpStream(chi, chin, chin, false), th, chout, &chi.In)
+		go MultiCopyClose(chout, th, chin, &chi.Out)
 	case "scpfrom":
-		go MultiCopyClose(chin, chout)
-		go MultiCopyClose(chout, chin, CreateScpStream(chi))
+		go MultiCopyClose(chin, th, chout, &chi.In)
+		go MultiCopyClose(CreateScpStream(chi, chout, chout, true), th, chin, &chi.Out)
+	case "sftp":
+		if chi.RecordLogsId == 0 {
+			chi.RecordLogsId, err = chi.insertRecordLogs(chi.Type, "", "", 0)
+			if err != nil {
+				return err
+			}
+		}
+		ss := CreateSftpStream(chi, chin, chin)
+		go MultiCopyClose(ss, th, chout, &chi.In)
+		go MultiCopyClose(chout, th, ss, &chi.Out)
 	default:
 		log.Warning("redirect before setup")
 		chin.Close()
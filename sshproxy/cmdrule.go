@@ -0,0 +1,464 @@
+package sshproxy
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// actions of CmdRule.
+const (
+	CMD_WARN  = "warn"
+	CMD_BLOCK = "block"
+	CMD_KILL  = "kill"
+)
+
+var cmdSeverity = map[string]int{
+	CMD_WARN:  1,
+	CMD_BLOCK: 2,
+	CMD_KILL:  3,
+}
+
+// CmdRule matches command lines user typed in shell or exec.
+type CmdRule struct {
+	// warn, block or kill.
+	Action  string
+	Pattern string
+	re      *regexp.Regexp
+}
+
+func (cr *CmdRule) String() string {
+	return cr.Action + " " + cr.Pattern
+}
+
+// ParseCmdRules reads rules, one per line, like "block rm\s+-rf\s+/".
+// Empty lines and lines begin with # are ignored.
+func ParseCmdRules(s string) (rules []*CmdRule) {
+	for _, line := range strings.Split(s, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.SplitN(line, " ", 2)
+		if len(i) < 2 {
+			i = append(i, "")
+		}
+		rules = append(rules, &CmdRule{
+			Action:  i[0],
+			Pattern: strings.TrimSpace(i[1]),
+		})
+	}
+	return
+}
+
+// compileCmdRules checks and compiles rules from backend.
+func compileCmdRules(rules []*CmdRule) (compiled []*CmdRule, err error) {
+	for _, rule := range rules {
+		if _, ok := cmdSeverity[rule.Action]; !ok {
+			err = fmt.Errorf("illegal action of command rule: %s", rule.String())
+			log.Error("%s", err.Error())
+			return
+		}
+		var re *regexp.Regexp
+		re, err = regexp.Compile(rule.Pattern)
+		if err != nil {
+			log.Error("%s", err.Error())
+			return
+		}
+		compiled = append(compiled, &CmdRule{
+			Action:  rule.Action,
+			Pattern: rule.Pattern,
+			re:      re,
+		})
+	}
+	return
+}
+
+func compilePatterns(patterns []string) (res []*regexp.Regexp, err error) {
+	for _, p := range patterns {
+		var re *regexp.Regexp
+		re, err = regexp.Compile(p)
+		if err != nil {
+			log.Error("%s", err.Error())
+			return
+		}
+		res = append(res, re)
+	}
+	return
+}
+
+// chkExec returns why cmd can't be executed, empty if it can.
+// Deny wins, and cmd must match one of allow if there is any.
+func (ci *ConnInfo) chkExec(cmd string) (reason string) {
+	if !ci.ChkPerm("exec") {
+		return "no exec perm"
+	}
+	for _, re := range ci.ExecDeny {
+		if re.MatchString(cmd) {
+			return "denied by " + re.String()
+		}
+	}
+	if len(ci.ExecAllow) == 0 {
+		return ""
+	}
+	for _, re := range ci.ExecAllow {
+		if re.MatchString(cmd) {
+			return ""
+		}
+	}
+	return "not in allowed commands"
+}
+
+// matchCmdRules returns the most severe rule matches line, nil if none.
+func matchCmdRules(rules []*CmdRule, line string) (rule *CmdRule) {
+	for _, r := range rules {
+		if !r.re.MatchString(line) {
+			continue
+		}
+		if rule == nil || cmdSeverity[r.Action] > cmdSeverity[rule.Action] {
+			rule = r
+		}
+	}
+	return
+}
+
+// checkCmd records command line hits a rule, and returns the rule.
+func (chi *ChanInfo) checkCmd(line string) (rule *CmdRule) {
+	rule = matchCmdRules(chi.ci.CmdRules, line)
+	if rule == nil {
+		return
+	}
+
+	log.Notice("command in session %d hit rule %s: %s", chi.ci.RecordId, rule.String(), line)
+	_, err := chi.insertRecordLogs("cmd", line, rule.String(), chi.RecordLogsId)
+	if err != nil {
+		log.Error("%s", err.Error())
+	}
+	return
+}
+
+const (
+	echoNormal = iota
+	echoEsc
+	echoCsi
+	echoOsc
+	echoOscEsc
+)
+
+// echoLine follows the last line of terminal output, which is the line
+// user is editing in shell. Only line editing sequences are understood.
+type echoLine struct {
+	mu     sync.Mutex
+	us     utf8Stream
+	buf    []rune
+	cur    int
+	state  int
+	params string
+}
+
+func (el *echoLine) Write(p []byte) (n int, err error) {
+	el.mu.Lock()
+	defer el.mu.Unlock()
+	for _, r := range el.us.decode(p) {
+		el.feed(r)
+	}
+	return len(p), nil
+}
+
+func (el *echoLine) Close() error {
+	return nil
+}
+
+func (el *echoLine) String() string {
+	el.mu.Lock()
+	defer el.mu.Unlock()
+	return string(el.buf)
+}
+
+func (el *echoLine) feed(r rune) {
+	switch el.state {
+	case echoEsc:
+		switch r {
+		case '[':
+			el.state, el.params = echoCsi, ""
+		case ']':
+			el.state = echoOsc
+		default:
+			el.state = echoNormal
+		}
+		return
+	case echoCsi:
+		if r >= 0x40 && r <= 0x7e {
+			el.state = echoNormal
+			el.csi(r)
+			return
+		}
+		el.params += string(r)
+		return
+	case echoOsc:
+		switch r {
+		case 0x07:
+			el.state = echoNormal
+		case 0x1b:
+			el.state = echoOscEsc
+		}
+		return
+	case echoOscEsc:
+		el.state = echoNormal
+		return
+	}
+
+	switch {
+	case r == 0x1b:
+		el.state = echoEsc
+	case r == '\r':
+		el.cur = 0
+	case r == '\n':
+		el.buf, el.cur = nil, 0
+	case r == '\b':
+		if el.cur > 0 {
+			el.cur--
+		}
+	case r < 0x20 || r == 0x7f:
+	default:
+		el.pad(el.cur + 1)
+		el.buf[el.cur] = r
+		el.cur++
+	}
+}
+
+func (el *echoLine) pad(n int) {
+	for len(el.buf) < n {
+		el.buf = append(el.buf, ' ')
+	}
+}
+
+func (el *echoLine) csi(final rune) {
+	n, err := strconv.Atoi(el.params)
+	if err != nil {
+		n = 0
+	}
+	switch final {
+	case 'K':
+		switch n {
+		case 0:
+			if el.cur < len(el.buf) {
+				el.buf = el.buf[:el.cur]
+			}
+		case 1:
+			for i := 0; i < el.cur && i < len(el.buf); i++ {
+				el.buf[i] = ' '
+			}
+		case 2:
+			el.buf = nil
+		}
+	case 'C':
+		if n == 0 {
+			n = 1
+		}
+		el.cur += n
+	case 'D':
+		if n == 0 {
+			n = 1
+		}
+		el.cur -= n
+		if el.cur < 0 {
+			el.cur = 0
+		}
+	case 'G':
+		el.cur = n - 1
+		if el.cur < 0 {
+			el.cur = 0
+		}
+	case 'P':
+		if n == 0 {
+			n = 1
+		}
+		if el.cur < len(el.buf) {
+			end := el.cur + n
+			if end > len(el.buf) {
+				end = len(el.buf)
+			}
+			el.buf = append(el.buf[:el.cur], el.buf[end:]...)
+		}
+	case '@':
+		if n == 0 {
+			n = 1
+		}
+		if el.cur < len(el.buf) {
+			ins := make([]rune, n)
+			for i := range ins {
+				ins[i] = ' '
+			}
+			el.buf = append(el.buf[:el.cur], append(ins, el.buf[el.cur:]...)...)
+		}
+	case 'H', 'J':
+		// screen cleared, such as ctrl-l.
+		el.buf, el.cur = nil, 0
+	}
+}
+
+// CmdFilter rebuilds command lines from input of channel, and checks them
+// with rules when user hits enter.
+// With pty, input is passed as typed, blocked line is cancelled by ctrl-c
+// instead of enter. Line is read from echo of output, unless user only typed
+// printable chars and backspace, so history and completion are seen as
+// what server got. Without pty, input is held until a whole line comes,
+// and blocked line is dropped, line longer than CMD_MAX_LINE closes the
+// channel. Kill closes the channel.
+type CmdFilter struct {
+	chi   *ChanInfo
+	r     io.Reader
+	user  io.Writer
+	pty   bool
+	echo  *echoLine
+	typed []byte
+	plain bool
+	// echoed line before user typed, mostly the prompt.
+	prompt  string
+	started bool
+	// line held, without pty.
+	pending []byte
+	out     []byte
+	err     error
+}
+
+func CreateCmdFilter(chi *ChanInfo, r io.Reader, user io.Writer, pty bool) (cf *CmdFilter) {
+	cf = &CmdFilter{
+		chi:   chi,
+		r:     r,
+		user:  user,
+		pty:   pty,
+		echo:  &echoLine{},
+		plain: true,
+	}
+	return
+}
+
+// Echo returns writer for output of channel.
+func (cf *CmdFilter) Echo() io.WriteCloser {
+	return cf.echo
+}
+
+func (cf *CmdFilter) reset() {
+	cf.typed, cf.plain = nil, true
+	cf.prompt, cf.started = "", false
+}
+
+func (cf *CmdFilter) input(c byte) {
+	if !cf.started {
+		cf.started = true
+		cf.prompt = cf.echo.String()
+	}
+
+	switch {
+	case c == 0x7f, c == 0x08:
+		if len(cf.typed) > 0 {
+			_, size := utf8.DecodeLastRune(cf.typed)
+			cf.typed = cf.typed[:len(cf.typed)-size]
+		}
+	case c == 0x15:
+		cf.typed = nil
+	case c == 0x03:
+		cf.reset()
+	case c >= 0x20:
+		cf.typed = append(cf.typed, c)
+	default:
+		// tab, escape sequences and other edits, only echo knows.
+		cf.plain = false
+	}
+}
+
+func (cf *CmdFilter) line() string {
+	switch {
+	case !cf.pty:
+		return strings.TrimSpace(string(cf.pending))
+	case cf.plain:
+		return strings.TrimSpace(string(cf.typed))
+	}
+	return strings.TrimSpace(strings.TrimPrefix(cf.echo.String(), cf.prompt))
+}
+
+// enter checks the line ended by term.
+func (cf *CmdFilter) enter(term []byte) {
+	line := cf.line()
+	pending := cf.pending
+	cf.pending = nil
+	cf.reset()
+
+	var rule *CmdRule
+	if line != "" {
+		rule = cf.chi.checkCmd(line)
+	}
+	switch {
+	case rule == nil:
+	case rule.Action == CMD_KILL:
+		fmt.Fprintf(cf.user, "\r\n*** command not allowed, channel closed ***\r\n")
+		cf.err = ErrCmdBlocked
+		return
+	case rule.Action == CMD_BLOCK:
+		fmt.Fprintf(cf.user, "\r\n*** command not allowed ***\r\n")
+		if cf.pty {
+			// cancel line in shell instead of running it.
+			cf.out = append(cf.out, 0x03)
+		}
+		return
+	default:
+		fmt.Fprintf(cf.user, "\r\n*** warning: command is audited ***\r\n")
+	}
+	cf.out = append(cf.out, pending...)
+	cf.out = append(cf.out, term...)
+}
+
+func (cf *CmdFilter) filter(b []byte) {
+	for i, c := range b {
+		if c == '\r' || c == '\n' {
+			cf.enter(b[i : i+1])
+			if cf.err != nil {
+				return
+			}
+			continue
+		}
+		if !cf.pty {
+			if len(cf.pending) >= CMD_MAX_LINE {
+				fmt.Fprintf(cf.user, "\r\n*** command line too long, channel closed ***\r\n")
+				cf.err = ErrCmdTooLong
+				return
+			}
+			cf.pending = append(cf.pending, c)
+			continue
+		}
+		cf.input(c)
+		cf.out = append(cf.out, c)
+	}
+}
+
+func (cf *CmdFilter) Read(p []byte) (n int, err error) {
+	if len(cf.chi.ci.CmdRules) == 0 {
+		return cf.r.Read(p)
+	}
+
+	for len(cf.out) == 0 {
+		if cf.err != nil {
+			return 0, cf.err
+		}
+		n, err = cf.r.Read(p)
+		cf.filter(p[:n])
+		if err != nil && cf.err == nil {
+			// last line without enter.
+			if len(cf.pending) != 0 {
+				cf.enter(nil)
+			}
+			if cf.err == nil {
+				cf.err = err
+			}
+		}
+	}
+	n = copy(p, cf.out)
+	cf.out = cf.out[n:]
+	return n, nil
+}
@@ -3,7 +3,8 @@ package sshproxy
 import (
 	"fmt"
 	"net"
-	"net/url"
+	"regexp"
+	"strconv"
 	"sync"
 	"time"
 
@@ -11,47 +12,54 @@ import (
 )
 
 type ConnInfo struct {
-	srv  *Server
-	wg   sync.WaitGroup
-	conn ssh.Conn
+	srv      *Server
+	wg       sync.WaitGroup
+	srvConn  *ssh.ServerConn
+	conn     ssh.Conn
+	mu       sync.Mutex
+	forwards map[string]*RemoteForward
+	chans    map[*ChanInfo]struct{}
 
 	Username string
 	Host     string
 	Account  string
 
-	Acct         *AccountInfo
-	Proxy        *AccountInfo
-	ProxyCommand string
-	Perms        map[string]int
+	Acct  *AccountInfo
+	Hops  []*HopInfo
+	Perms map[string]int
+	// compiled, empty means no check.
+	CmdRules  []*CmdRule
+	DlpRules  []*DlpRule
+	ExecAllow []*regexp.Regexp
+	ExecDeny  []*regexp.Regexp
+	// capture mode of transferred files, and max size to store.
+	Capture    string
+	CaptureMax int
+	// limits of scp, 0 for no limit.
+	ScpMaxFile int
+	ScpQuota   int
+	scpBytes   int
+	// bytes per second of channel classes, and buckets of them.
+	RateLimits map[string]int
+	buckets    map[string]*TokenBucket
 
 	RecordId  int
 	Starttime time.Time
+	Remote    string
+
+	// bytes from user, and bytes to user, of all channels ever opened.
+	In  ByteCounter
+	Out ByteCounter
 }
 
 func (ci *ConnInfo) loadAccount() (err error) {
-	v := &url.Values{}
-	v.Add("username", ci.Username)
-	v.Add("account", ci.Account)
-	v.Add("host", ci.Host)
-
-	type AccountRsltProxy struct {
-		AccountInfo
-		Proxy        *AccountInfo
-		ProxyCommand string
-		Perms        []string
-	}
-	rslt := &AccountRsltProxy{}
-
-	err = ci.srv.GetJson("/l/h", false, v, rslt)
+	rslt, err := ci.srv.GetAccount(ci.Username, ci.Account, ci.Host)
 	if err != nil {
 		return
 	}
 
 	ci.Acct = &rslt.AccountInfo
-	if rslt.Proxy != nil {
-		ci.Proxy = rslt.Proxy
-		ci.ProxyCommand = rslt.ProxyCommand
-	}
+	ci.Hops = rslt.Hops
 
 	log.Info("query perms: %s / %s@%s => %v.", ci.Username, ci.Account, ci.Host, rslt.Perms)
 	for _, p := range rslt.Perms {
@@ -62,11 +70,48 @@ func (ci *ConnInfo) loadAccount() (err error) {
 		log.Error("%s", err.Error())
 		return
 	}
+
+	ci.CmdRules, err = compileCmdRules(rslt.CmdRules)
+	if err != nil {
+		return
+	}
+	ci.DlpRules, err = compileDlpRules(rslt.DlpRules)
+	if err != nil {
+		return
+	}
+	ci.ExecAllow, err = compilePatterns(rslt.ExecAllow)
+	if err != nil {
+		return
+	}
+	ci.ExecDeny, err = compilePatterns(rslt.ExecDeny)
+	if err != nil {
+		return
+	}
+
+	if _, ok := captureLevel[rslt.Capture]; !ok {
+		err = fmt.Errorf("illegal capture mode: %s", rslt.Capture)
+		log.Error("%s", err.Error())
+		return
+	}
+	ci.Capture, ci.CaptureMax = rslt.Capture, rslt.CaptureMax
+	ci.ScpMaxFile, ci.ScpQuota = rslt.ScpMaxFile, rslt.ScpQuota
+	ci.RateLimits, err = parseRateLimits(rslt.RateLimits)
 	return
 }
 
+// Close disconnects both user and target host.
 func (ci *ConnInfo) Close() (err error) {
-	return ci.conn.Close()
+	ci.mu.Lock()
+	srvConn, conn := ci.srvConn, ci.conn
+	ci.mu.Unlock()
+
+	if srvConn != nil {
+		srvConn.Close()
+	}
+	if conn != nil {
+		err = conn.Close()
+	}
+	return
 }
 
 func (ci *ConnInfo) ChkPerm(name string) (ok bool) {
@@ -75,85 +120,130 @@ func (ci *ConnInfo) ChkPerm(name string) (ok bool) {
 }
 
 func (ci *ConnInfo) insertRecord() (err error) {
-	v := &url.Values{}
-	v.Add("username", ci.Username)
-	v.Add("account", ci.Account)
-	v.Add("host", ci.Host)
-
-	type RecordRslt struct {
-		Recordid  int
-		Starttime string
-	}
-	rslt := &RecordRslt{}
+	ci.RecordId, ci.Starttime, err = ci.srv.InsertRecord(
+		ci.Username, ci.Account, ci.Host)
+	return
+}
 
-	err = ci.srv.GetJson("/l/rec", true, v, rslt)
+// clientConfig tries certificate signed by account ca first if we have one,
+// then key and password of account.
+func (ci *ConnInfo) clientConfig(ai *AccountInfo) (config *ssh.ClientConfig, err error) {
+	config, err = ai.ClientConfig()
 	if err != nil {
 		return
 	}
-	ci.RecordId = rslt.Recordid
-	ci.Starttime, err = time.Parse("2006-01-02T15:04:05", rslt.Starttime)
+	_, _, aca := ci.srv.keys()
+	if aca == nil {
+		return
+	}
+
+	signer, err := aca.CreateCertSigner(ai.Account,
+		fmt.Sprintf("sshproxy:%s:%d", ci.Username, ci.RecordId), uint64(ci.RecordId))
 	if err != nil {
-		log.Error("%s", err.Error())
 		return
 	}
+	config.Auth = append([]ssh.AuthMethod{ssh.PublicKeys(signer)}, config.Auth...)
 	return
 }
 
-func (ci *ConnInfo) clientBuilder() (client ssh.Conn, chans <-chan ssh.NewChannel, reqs <-chan *ssh.Request, err error) {
-	// and try connect it as last step
-	hostname := fmt.Sprintf("%s:%d", ci.Acct.Hostname, ci.Acct.Port)
-	var conn net.Conn
+// dial connects to ai, directly if jump is nil, or else from jump,
+// with direct-tcpip, or proxycommand if it's set.
+func (ci *ConnInfo) dial(jump *ssh.Client, proxycommand string, ai *AccountInfo) (conn net.Conn, err error) {
+	hostname := net.JoinHostPort(ai.Hostname, strconv.Itoa(ai.Port))
 	switch {
-	case ci.Proxy != nil:
-		log.Info("ssh proxy: %s:%d with proxy %s@%s:%d",
-			ci.Acct.Hostname, ci.Acct.Port,
-			ci.Proxy.Account, ci.Proxy.Hostname, ci.Proxy.Port)
-		conn, err = ci.connectProxy(ci.Acct.Hostname, ci.Acct.Port)
+	case jump == nil:
+		log.Info("dail: %s", hostname)
+		conn, err = net.DialTimeout("tcp", hostname, HANDSHAKE_TIMEOUT)
+		if err != nil {
+			log.Error("tcp dial failed: %s", err.Error())
+			return
+		}
+	case proxycommand != "":
+		var cmd string
+		cmd, err = fmtCmd(proxycommand, ai.Hostname, ai.Port)
+		if err != nil {
+			return
+		}
+		log.Debug("cmd: %s", cmd)
+
+		conn, err = createCmdNet(jump, cmd)
 		if err != nil {
 			log.Error("ssh dial failed: %s", err.Error())
 			return
 		}
 	default:
-		log.Info("dail: %s", hostname)
-		conn, err = net.Dial("tcp", hostname)
+		log.Info("direct-tcpip: %s", hostname)
+		conn, err = createTcpNet(jump, hostname)
 		if err != nil {
-			log.Error("tcp dial failed: %s", err.Error())
+			log.Error("ssh dial failed: %s", err.Error())
 			return
 		}
 	}
+	return
+}
 
-	config, err := ci.Acct.ClientConfig()
+func (ci *ConnInfo) handshake(conn net.Conn, ai *AccountInfo) (client ssh.Conn, chans <-chan ssh.NewChannel, reqs <-chan *ssh.Request, err error) {
+	config, err := ci.clientConfig(ai)
 	if err != nil {
+		conn.Close()
 		return
 	}
+	hostname := net.JoinHostPort(ai.Hostname, strconv.Itoa(ai.Port))
+
+	conn.SetDeadline(time.Now().Add(HANDSHAKE_TIMEOUT))
 	client, chans, reqs, err = ssh.NewClientConn(conn, hostname, config)
 	if err != nil {
 		log.Error("ssh client conn failed: %s", err.Error())
+		conn.Close()
 		return
 	}
+	conn.SetDeadline(time.Time{})
 	return
 }
 
-func (ci *ConnInfo) connectProxy(desthost string, destport int) (conn net.Conn, err error) {
-	config, err := ci.Proxy.ClientConfig()
-	if err != nil {
-		return
-	}
+// clientBuilder connects every hop in turn, and the target host as last step.
+// Host key is checked at every hop, and each hop is recorded.
+func (ci *ConnInfo) clientBuilder() (client ssh.Conn, chans <-chan ssh.NewChannel, reqs <-chan *ssh.Request, err error) {
+	var jump *ssh.Client
+	var proxycommand string
+	defer func() {
+		if err != nil && jump != nil {
+			jump.Close()
+		}
+	}()
 
-	log.Info("ssh to %s@%s:%d", ci.Proxy.Account, ci.Proxy.Hostname, ci.Proxy.Port)
-	client, err := ssh.Dial("tcp",
-		fmt.Sprintf("%s:%d", ci.Proxy.Hostname, ci.Proxy.Port), config)
-	if err != nil {
-		return
+	for i, hop := range ci.Hops {
+		log.Info("ssh hop %d: %s@%s:%d", i, hop.Account, hop.Hostname, hop.Port)
+		_, err = ci.srv.InsertRecordLogs(ci.RecordId, "hop",
+			fmt.Sprintf("%s@%s:%d", hop.Account, hop.Hostname, hop.Port),
+			hop.ProxyCommand, i)
+		if err != nil {
+			return
+		}
+
+		var conn net.Conn
+		conn, err = ci.dial(jump, proxycommand, &hop.AccountInfo)
+		if err != nil {
+			return
+		}
+
+		var c ssh.Conn
+		var chs <-chan ssh.NewChannel
+		var rs <-chan *ssh.Request
+		c, chs, rs, err = ci.handshake(conn, &hop.AccountInfo)
+		if err != nil {
+			return
+		}
+		// conn of new client closes the last one.
+		jump = ssh.NewClient(c, chs, rs)
+		proxycommand = hop.ProxyCommand
 	}
 
-	cmd, err := fmtCmd(ci.ProxyCommand, desthost, destport)
+	conn, err := ci.dial(jump, proxycommand, ci.Acct)
 	if err != nil {
 		return
 	}
-	log.Debug("cmd: %s", cmd)
-
-	return createPipeNet(client, cmd)
+	return ci.handshake(conn, ci.Acct)
 }
 
 func (ci *ConnInfo) serveReq(conn ssh.Conn, req *ssh.Request) (err error) {
@@ -179,7 +269,12 @@ func (ci *ConnInfo) serveReqs(conn ssh.Conn, reqs <-chan *ssh.Request) (err erro
 	for req := range reqs {
 		log.Debug("new req: %s(reply: %t, payload: %d).",
 			req.Type, req.WantReply, len(req.Payload))
-		err = ci.serveReq(conn, req)
+		switch {
+		case conn == ci.conn && (req.Type == "tcpip-forward" || req.Type == "cancel-tcpip-forward"):
+			err = ci.serveForwardReq(req)
+		default:
+			err = ci.serveReq(conn, req)
+		}
 		if err != nil {
 			log.Error("%s", err.Error())
 		}
@@ -193,23 +288,37 @@ func (ci *ConnInfo) serveChans(conn ssh.Conn, chans <-chan ssh.NewChannel) (err
 	defer conn.Close()
 	log.Debug("chans begin.")
 	for newChan := range chans {
-		chi := CreateChanInfo(ci)
-		err = chi.Serve(conn, newChan)
-		if err != nil {
-			log.Error("%s", err.Error())
-		}
+		// channel may be held for approval, don't block the others.
+		go func(newChan ssh.NewChannel) {
+			chi := CreateChanInfo(ci)
+			err := chi.Serve(conn, newChan)
+			if err != nil {
+				log.Error("%s", err.Error())
+			}
+		}(newChan)
 	}
 	log.Debug("chans ends.")
 	return
 }
 
 func (ci *ConnInfo) Serve(srvConn *ssh.ServerConn, srvChans <-chan ssh.NewChannel, srvReqs <-chan *ssh.Request) (err error) {
+	ci.mu.Lock()
+	ci.srvConn = srvConn
+	ci.Remote = srvConn.RemoteAddr().String()
+	ci.mu.Unlock()
+
 	conn, cliChans, cliReqs, err := ci.clientBuilder()
 	if err != nil {
 		return
 	}
 	defer conn.Close()
+	ci.mu.Lock()
 	ci.conn = conn
+	ci.mu.Unlock()
+	ci.srv.addConn(ci)
+	defer ci.srv.removeConn(ci.RecordId)
+	ci.buckets = ci.srv.acquireBuckets(ci.Username, ci.RateLimits)
+	defer ci.srv.releaseBuckets(ci.Username, ci.RateLimits)
 
 	log.Debug("handshake ok")
 
@@ -225,7 +334,5 @@ func (ci *ConnInfo) Serve(srvConn *ssh.ServerConn, srvChans <-chan ssh.NewChanne
 }
 
 func (ci *ConnInfo) updateEndtime() (err error) {
-	v := &url.Values{}
-	v.Add("recordid", fmt.Sprintf("%d", ci.RecordId))
-	return ci.srv.GetJson("/l/end", true, v, nil)
+	return ci.srv.UpdateEndtime(ci.RecordId)
 }
@@ -0,0 +1,186 @@
+package sshproxy
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// actions of DlpRule.
+const (
+	DLP_LOG   = "log"
+	DLP_ALERT = "alert"
+	DLP_ABORT = "abort"
+)
+
+var dlpActions = map[string]bool{
+	DLP_LOG:   true,
+	DLP_ALERT: true,
+	DLP_ABORT: true,
+}
+
+// builtin patterns of DlpRule, others are regexps.
+const (
+	DLP_PRIVATEKEY = "@privatekey"
+	DLP_CREDITCARD = "@creditcard"
+)
+
+var (
+	reDlpPrivateKey = regexp.MustCompile(`-----BEGIN [A-Z0-9 ]*PRIVATE KEY( BLOCK)?-----`)
+	reDlpCardNumber = regexp.MustCompile(`\b\d(?:[ -]?\d){12,18}\b`)
+)
+
+// bytes kept from last chunk, so matches across chunks are seen.
+const dlpOverlap = 1024
+
+// DlpRule matches content of files transferred.
+type DlpRule struct {
+	// log, alert or abort.
+	Action  string
+	Pattern string
+	re      *regexp.Regexp
+}
+
+func (dr *DlpRule) String() string {
+	return dr.Action + " " + dr.Pattern
+}
+
+func (dr *DlpRule) match(b []byte) bool {
+	if dr.Pattern != DLP_CREDITCARD {
+		return dr.re.Match(b)
+	}
+	for _, m := range dr.re.FindAll(b, -1) {
+		if luhn(m) {
+			return true
+		}
+	}
+	return false
+}
+
+// luhn checks digits in b, separators skipped.
+func luhn(b []byte) bool {
+	sum, n := 0, 0
+	for i := len(b) - 1; i >= 0; i-- {
+		if b[i] < '0' || b[i] > '9' {
+			continue
+		}
+		d := int(b[i] - '0')
+		if n%2 == 1 {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		n++
+	}
+	return n >= 13 && sum%10 == 0
+}
+
+// ParseDlpRules reads rules like "abort @privatekey", in format of ParseCmdRules.
+func ParseDlpRules(s string) (rules []*DlpRule) {
+	for _, cr := range ParseCmdRules(s) {
+		rules = append(rules, &DlpRule{Action: cr.Action, Pattern: cr.Pattern})
+	}
+	return
+}
+
+// compileDlpRules checks and compiles rules from backend.
+func compileDlpRules(rules []*DlpRule) (compiled []*DlpRule, err error) {
+	for _, rule := range rules {
+		if !dlpActions[rule.Action] {
+			err = fmt.Errorf("illegal action of dlp rule: %s", rule.String())
+			log.Error("%s", err.Error())
+			return
+		}
+		var re *regexp.Regexp
+		switch rule.Pattern {
+		case DLP_PRIVATEKEY:
+			re = reDlpPrivateKey
+		case DLP_CREDITCARD:
+			re = reDlpCardNumber
+		default:
+			re, err = regexp.Compile(rule.Pattern)
+			if err != nil {
+				log.Error("%s", err.Error())
+				return
+			}
+		}
+		compiled = append(compiled, &DlpRule{
+			Action:  rule.Action,
+			Pattern: rule.Pattern,
+			re:      re,
+		})
+	}
+	return
+}
+
+// DlpScanner scans a file chunk by chunk, each rule hits at most once.
+type DlpScanner struct {
+	rules []*DlpRule
+	tail  []byte
+	hits  map[*DlpRule]bool
+}
+
+func CreateDlpScanner(rules []*DlpRule) (ds *DlpScanner) {
+	return &DlpScanner{
+		rules: rules,
+		hits:  make(map[*DlpRule]bool, 0),
+	}
+}
+
+// Scan returns rules hit first time in p.
+func (ds *DlpScanner) Scan(p []byte) (rules []*DlpRule) {
+	buf := append(ds.tail, p...)
+	for _, r := range ds.rules {
+		if ds.hits[r] || !r.match(buf) {
+			continue
+		}
+		ds.hits[r] = true
+		rules = append(rules, r)
+	}
+
+	if len(buf) > dlpOverlap {
+		buf = buf[len(buf)-dlpOverlap:]
+	}
+	ds.tail = append([]byte{}, buf...)
+	return
+}
+
+// checkDlp records rules hit by content of file in transfer,
+// and returns ErrDlpAbort if any of them aborts.
+func (chi *ChanInfo) checkDlp(b []byte) (err error) {
+	var abort *DlpRule
+	for _, rule := range chi.dlp.Scan(b) {
+		log.Warning("%s in session %d hit dlp rule %s: %s",
+			chi.Type, chi.ci.RecordId, rule.String(), chi.file)
+		_, err = chi.insertRecordLogs("dlp", chi.file, rule.String(), chi.RecordLogsId)
+		if err != nil {
+			return
+		}
+
+		switch rule.Action {
+		case DLP_ALERT, DLP_ABORT:
+			err = chi.ci.srv.InsertAuditLogs(chi.ci.Username, fmt.Sprintf(
+				"dlp %s: %s %s in session %d", rule.String(), chi.Type, chi.file, chi.ci.RecordId))
+			if err != nil {
+				return
+			}
+		}
+		if rule.Action == DLP_ABORT {
+			abort = rule
+		}
+	}
+	if abort == nil {
+		return
+	}
+
+	// user is sink in download, anything in stdout goes into the file,
+	// so tell it in stderr, and the channel will be closed.
+	if chi.Type == "scpfrom" {
+		fmt.Fprintf(chi.user.Stderr(), "%s: %s\r\n", chi.file, ErrDlpAbort.Error())
+		return ErrDlpAbort
+	}
+	// fatal error of scp protocol, then the channel will be closed.
+	fmt.Fprintf(chi.user, "\x02%s: %s\n", chi.file, ErrDlpAbort.Error())
+	return ErrDlpAbort
+}
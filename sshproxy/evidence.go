@@ -0,0 +1,118 @@
+package sshproxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// capture modes of transferred files.
+const (
+	CAPTURE_HASH = "hash"
+	CAPTURE_FULL = "full"
+)
+
+var captureLevel = map[string]int{
+	"":           0,
+	CAPTURE_HASH: 1,
+	CAPTURE_FULL: 2,
+}
+
+// Evidence hashes content of a transferred file, and in full mode, stores
+// it under Logdir/files, named by sha256, so the same content is kept once.
+// Content larger than max is only hashed, 0 means no limit.
+type Evidence struct {
+	dir  string
+	max  int
+	h    hash.Hash
+	f    *os.File
+	Size int
+}
+
+func CreateEvidence(logdir, mode string, max int) (ev *Evidence, err error) {
+	ev = &Evidence{
+		dir: filepath.Join(logdir, "files"),
+		max: max,
+		h:   sha256.New(),
+	}
+	if mode != CAPTURE_FULL {
+		return
+	}
+
+	err = os.MkdirAll(ev.dir, 0700)
+	if err != nil {
+		log.Error("%s", err.Error())
+		return
+	}
+	ev.f, err = ioutil.TempFile(ev.dir, ".capture")
+	if err != nil {
+		log.Error("%s", err.Error())
+		return
+	}
+	return
+}
+
+// drop stops storing, only hash goes on.
+func (ev *Evidence) drop() {
+	if ev.f == nil {
+		return
+	}
+	ev.f.Close()
+	os.Remove(ev.f.Name())
+	ev.f = nil
+}
+
+func (ev *Evidence) Write(p []byte) (n int, err error) {
+	ev.h.Write(p)
+	ev.Size += len(p)
+
+	if ev.f != nil && ev.max > 0 && ev.Size > ev.max {
+		log.Warning("captured file larger than %d, only hash kept.", ev.max)
+		ev.drop()
+	}
+	if ev.f != nil {
+		_, err = ev.f.Write(p)
+		if err != nil {
+			log.Error("%s", err.Error())
+			ev.drop()
+		}
+	}
+	return len(p), nil
+}
+
+// Finish returns sha256 of content, and moves stored file into place.
+func (ev *Evidence) Finish() (sum string, stored bool, err error) {
+	sum = hex.EncodeToString(ev.h.Sum(nil))
+	if ev.f == nil {
+		return
+	}
+	defer ev.drop()
+
+	err = ev.f.Close()
+	if err != nil {
+		log.Error("%s", err.Error())
+		return
+	}
+
+	dir := filepath.Join(ev.dir, sum[:2])
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		log.Error("%s", err.Error())
+		return
+	}
+	target := filepath.Join(dir, sum)
+	if _, e := os.Stat(target); e == nil {
+		// same content stored before.
+		return sum, true, nil
+	}
+	err = os.Rename(ev.f.Name(), target)
+	if err != nil {
+		log.Error("%s", err.Error())
+		return
+	}
+	ev.f = nil
+	return sum, true, nil
+}
@@ -0,0 +1,140 @@
+package sshproxy
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// RemoteForward is a port bound on target host by tcpip-forward.
+type RemoteForward struct {
+	Addr         string
+	Port         uint32
+	RecordLogsId int
+}
+
+func (rf *RemoteForward) String() string {
+	return fmt.Sprintf("%s:%d", rf.Addr, rf.Port)
+}
+
+func parseForwardReq(payload []byte) (addr string, port uint32, err error) {
+	addr, payload, err = ReadPayloadString(payload)
+	if err != nil {
+		return
+	}
+	port, _, err = ReadPayloadUint32(payload)
+	return
+}
+
+// serveForwardReq handles tcpip-forward and cancel-tcpip-forward from user.
+func (ci *ConnInfo) serveForwardReq(req *ssh.Request) (err error) {
+	addr, port, err := parseForwardReq(req.Payload)
+	if err != nil {
+		log.Error("%s", err.Error())
+		req.Reply(false, nil)
+		return
+	}
+
+	if !ci.ChkPerm("remoteforward") {
+		log.Warning("remote forward %s:%d refused.", addr, port)
+		req.Reply(false, nil)
+		return ErrNoPerms
+	}
+
+	r, b, err := ci.conn.SendRequest(req.Type, req.WantReply, req.Payload)
+	if err != nil {
+		log.Error("%s", err.Error())
+		req.Reply(false, nil)
+		return
+	}
+	log.Debug("send req ok: %s(result: %t)(payload: %d)", req.Type, r, len(b))
+
+	if r {
+		switch req.Type {
+		case "tcpip-forward":
+			// server choose the port if port is 0.
+			if port == 0 && len(b) >= 4 {
+				port = binary.BigEndian.Uint32(b[:4])
+			}
+			err = ci.addRemoteForward(addr, port)
+			if err != nil {
+				// binding unknown to us should not stay on target.
+				ci.cancelForward(addr, port)
+			}
+		case "cancel-tcpip-forward":
+			err = ci.removeRemoteForward(addr, port)
+		}
+		if err != nil {
+			req.Reply(false, nil)
+			return
+		}
+	}
+
+	return req.Reply(r, b)
+}
+
+func (ci *ConnInfo) addRemoteForward(addr string, port uint32) (err error) {
+	log.Notice("remote forward %s:%d", addr, port)
+	rf := &RemoteForward{Addr: addr, Port: port}
+	rf.RecordLogsId, err = ci.srv.InsertRecordLogs(
+		ci.RecordId, "remoteforward", addr, "", int(port))
+	if err != nil {
+		return
+	}
+
+	ci.mu.Lock()
+	defer ci.mu.Unlock()
+	ci.forwards[rf.String()] = rf
+	return
+}
+
+// cancelForward unbinds addr:port on target host.
+func (ci *ConnInfo) cancelForward(addr string, port uint32) {
+	payload := ssh.Marshal(struct {
+		Addr string
+		Port uint32
+	}{addr, port})
+	_, _, err := ci.conn.SendRequest("cancel-tcpip-forward", true, payload)
+	if err != nil {
+		log.Error("%s", err.Error())
+	}
+}
+
+func (ci *ConnInfo) removeRemoteForward(addr string, port uint32) (err error) {
+	log.Notice("cancel remote forward %s:%d", addr, port)
+	rf := &RemoteForward{Addr: addr, Port: port}
+
+	ci.mu.Lock()
+	delete(ci.forwards, rf.String())
+	ci.mu.Unlock()
+
+	_, err = ci.srv.InsertRecordLogs(
+		ci.RecordId, "cancelforward", addr, "", int(port))
+	return
+}
+
+// getRemoteForward finds the binding of forwarded-tcpip channel.
+// Server may send address in other form, so port only is acceptable
+// if there is just one binding on that port.
+func (ci *ConnInfo) getRemoteForward(addr string, port uint32) (rf *RemoteForward) {
+	ci.mu.Lock()
+	defer ci.mu.Unlock()
+
+	rf, ok := ci.forwards[fmt.Sprintf("%s:%d", addr, port)]
+	if ok {
+		return
+	}
+
+	rf = nil
+	for _, f := range ci.forwards {
+		if f.Port != port {
+			continue
+		}
+		if rf != nil {
+			return nil
+		}
+		rf = f
+	}
+	return
+}
@@ -0,0 +1,304 @@
+package sshproxy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Approval holds a channel on sensitive host until another user approves
+// it, by joining with id of recordlog of the channel.
+type Approval struct {
+	chi      *ChanInfo
+	mu       sync.Mutex
+	approved chan struct{}
+	abort    chan struct{}
+	once     sync.Once
+	approver string
+}
+
+func (ap *Approval) isApproved() bool {
+	if ap == nil {
+		return true
+	}
+	select {
+	case <-ap.approved:
+		return true
+	default:
+		return false
+	}
+}
+
+func (ap *Approval) cancel() {
+	if ap == nil {
+		return
+	}
+	ap.once.Do(func() { close(ap.abort) })
+}
+
+// approve returns true if channel is approved by username just now.
+func (ap *Approval) approve(username string) (ok bool, err error) {
+	if ap == nil {
+		return
+	}
+	ap.mu.Lock()
+	defer ap.mu.Unlock()
+	if ap.isApproved() {
+		return
+	}
+	select {
+	case <-ap.abort:
+		return
+	default:
+	}
+
+	log.Notice("session %d approved by %s", ap.chi.RecordLogsId, username)
+	ap.approver = username
+	close(ap.approved)
+	_, err = ap.chi.insertRecordLogs("approve", username, "", ap.chi.RecordLogsId)
+	return true, err
+}
+
+// createApproval makes channel wait for approval, if host is sensitive.
+// Recordlog of channel is created if not yet, so approver can find it.
+func (chi *ChanInfo) createApproval(log1 string) (err error) {
+	if !chi.ci.Acct.Sensitive {
+		return
+	}
+	if chi.RecordLogsId == 0 {
+		chi.RecordLogsId, err = chi.insertRecordLogs(chi.Type, log1, "", 0)
+		if err != nil {
+			return
+		}
+	}
+	chi.ap = &Approval{
+		chi:      chi,
+		approved: make(chan struct{}),
+		abort:    make(chan struct{}),
+	}
+	chi.ci.srv.addApproval(chi.RecordLogsId, chi.ap)
+	return
+}
+
+// hold waits until the channel approved, before request goes to target.
+// Returns error if timeout or user quit.
+func (chi *ChanInfo) hold() (err error) {
+	ap := chi.ap
+	if ap == nil {
+		return
+	}
+	defer chi.ci.srv.removeApproval(chi.RecordLogsId)
+
+	// forwarded channels are held before accepted, nobody to tell.
+	w, hint := ioutil.Discard, ""
+	switch {
+	case chi.Type == "shell":
+		w, hint = chi.user, ", ctrl-c to quit"
+	case chi.user != nil:
+		w = chi.user.Stderr()
+	}
+	fmt.Fprintf(w, "*** sensitive host, waiting for approval of session %d%s ***\r\n", chi.RecordLogsId, hint)
+
+	timer := time.NewTimer(APPROVE_TIMEOUT)
+	defer timer.Stop()
+	select {
+	case <-ap.approved:
+		fmt.Fprintf(w, "*** approved by %s ***\r\n", ap.approver)
+		return
+	case <-ap.abort:
+	case <-timer.C:
+		fmt.Fprintf(w, "*** approval timeout ***\r\n")
+	}
+
+	err = ErrNotApproved
+	log.Error("%s: %d", err.Error(), chi.RecordLogsId)
+	return
+}
+
+// waitApproval holds channel until approved, if host is sensitive.
+func (chi *ChanInfo) waitApproval(log1 string) (err error) {
+	err = chi.createApproval(log1)
+	if err != nil {
+		return
+	}
+	return chi.hold()
+}
+
+func (srv *Server) addApproval(id int, ap *Approval) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	srv.holds[id] = ap
+}
+
+func (srv *Server) removeApproval(id int) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	delete(srv.holds, id)
+}
+
+func (srv *Server) getApproval(id int) (ap *Approval, err error) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	ap, ok := srv.holds[id]
+	if !ok {
+		return nil, ErrSessionNotFound
+	}
+	return
+}
+
+// holdReader drops input of shell before approved, and ctrl-c aborts.
+type holdReader struct {
+	ap *Approval
+	r  io.Reader
+}
+
+func (hr *holdReader) Read(p []byte) (n int, err error) {
+	for {
+		n, err = hr.r.Read(p)
+		if hr.ap.isApproved() {
+			return
+		}
+		if err != nil {
+			hr.ap.cancel()
+			return
+		}
+		if bytes.IndexByte(p[:n], 0x03) != -1 {
+			hr.ap.cancel()
+			return 0, ErrNotApproved
+		}
+	}
+}
+
+// JoinInfo co-drives an active shell channel. Output is mirrored to it,
+// and its input is merged into the session, recorded as REC_JOIN.
+// Joining a channel waiting for approval approves it, channel other than
+// shell can only be approved.
+type JoinInfo struct {
+	srv          *Server
+	Username     string
+	RecordLogsId int
+	tap          *LiveTap
+	ap           *Approval
+}
+
+func (ji *JoinInfo) init() (err error) {
+	user, err := ji.srv.GetUser(ji.Username)
+	if err != nil {
+		return
+	}
+	if !user.ChkRule("approve") {
+		return ErrNoPerms
+	}
+
+	var chi *ChanInfo
+	ji.tap, err = ji.srv.getTap(ji.RecordLogsId)
+	if err == nil {
+		chi = ji.tap.chi
+	} else {
+		ji.ap, err = ji.srv.getApproval(ji.RecordLogsId)
+		if err != nil {
+			log.Error("%s: %d", err.Error(), ji.RecordLogsId)
+			return
+		}
+		chi = ji.ap.chi
+	}
+
+	// four eyes, user can't approve himself.
+	if chi.ci.Username == ji.Username {
+		err = ErrNoPerms
+		log.Error("%s: %s join his own session", err.Error(), ji.Username)
+		return
+	}
+
+	return ji.srv.InsertAuditLogs(ji.Username,
+		fmt.Sprintf("join sess id: %d", ji.RecordLogsId))
+}
+
+func (ji *JoinInfo) serveChan(ch ssh.Channel, reqs <-chan *ssh.Request) {
+	defer ch.Close()
+	go AcceptRequests(reqs)
+	log.Info("join chan begin.")
+
+	if ji.tap == nil {
+		ok, err := ji.ap.approve(ji.Username)
+		if err != nil {
+			return
+		}
+		if !ok {
+			fmt.Fprintf(ch, "session %d closed.\r\n", ji.RecordLogsId)
+			return
+		}
+		fmt.Fprintf(ch, "*** approved session %d ***\r\n", ji.RecordLogsId)
+		return
+	}
+
+	tap := ji.tap
+	w := tap.attach()
+	if w == nil {
+		fmt.Fprintf(ch, "session %d closed.\r\n", ji.RecordLogsId)
+		return
+	}
+	defer tap.detach(w)
+
+	_, err := tap.chi.insertRecordLogs("join", ji.Username, "", ji.RecordLogsId)
+	if err != nil {
+		return
+	}
+	_, err = tap.chi.ap.approve(ji.Username)
+	if err != nil {
+		return
+	}
+	fmt.Fprintf(tap.user, "\r\n*** %s joined your session ***\r\n", ji.Username)
+	fmt.Fprintf(ch, "*** joined session %d ***\r\n", ji.RecordLogsId)
+
+	// input of joined user goes through rules and limits of the session.
+	sl := tap.logger.CreateSubLogger(REC_JOIN)
+	cf := CreateCmdFilter(tap.chi, ch, ch.Stderr(), tap.chi.Term != "")
+	th := tap.chi.throttle()
+	go func() {
+		defer tap.detach(w)
+		defer sl.Close()
+		// target is not closed when joined user leaves.
+		_, err := io.Copy(io.MultiWriter(th, tap.target, sl), cf)
+		if err != nil {
+			log.Error("%s", err.Error())
+		}
+	}()
+
+	echo := cf.Echo()
+	for p := range w {
+		echo.Write(p)
+		_, err = ch.Write(p)
+		if err != nil {
+			log.Error("%s", err.Error())
+			break
+		}
+	}
+	fmt.Fprintf(tap.user, "\r\n*** %s left the session ***\r\n", ji.Username)
+	log.Info("join chan end.")
+}
+
+func (ji *JoinInfo) Serve(srvConn *ssh.ServerConn, srvChans <-chan ssh.NewChannel, srvReqs <-chan *ssh.Request) (err error) {
+	go ssh.DiscardRequests(srvReqs)
+	log.Info("join connect begin.")
+
+	for newChan := range srvChans {
+		if newChan.ChannelType() != "session" {
+			newChan.Reject(ssh.ResourceShortage, "not session")
+			continue
+		}
+		ch, reqs, err := newChan.Accept()
+		if err != nil {
+			log.Error("%s", err.Error())
+			continue
+		}
+		go ji.serveChan(ch, reqs)
+	}
+	log.Info("join connect closed.")
+	return
+}
@@ -0,0 +1,368 @@
+package sshproxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"math/big"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	KRL_MAGIC          = 0x5353484b524c0a00
+	KRL_FORMAT_VERSION = 1
+
+	KRL_SECTION_CERTIFICATES       = 1
+	KRL_SECTION_EXPLICIT_KEY       = 2
+	KRL_SECTION_FINGERPRINT_SHA1   = 3
+	KRL_SECTION_SIGNATURES         = 4
+	KRL_SECTION_FINGERPRINT_SHA256 = 5
+
+	KRL_SECTION_CERT_SERIAL_LIST   = 0x20
+	KRL_SECTION_CERT_SERIAL_RANGE  = 0x21
+	KRL_SECTION_CERT_SERIAL_BITMAP = 0x22
+	KRL_SECTION_CERT_KEY_ID        = 0x23
+)
+
+type serialRange struct {
+	min uint64
+	max uint64
+}
+
+// revokedCerts is what revoked for one CA, "" for any CA.
+type revokedCerts struct {
+	serials []serialRange
+	bitmaps map[uint64]*big.Int
+	keyids  map[string]bool
+}
+
+// RevokedKeys holds keys and certs revoked, from an OpenSSH KRL,
+// or from a text list like the spec file of ssh-keygen -k.
+type RevokedKeys struct {
+	certs  map[string]*revokedCerts
+	keys   map[string]bool
+	sha1   map[string]bool
+	sha256 map[string]bool
+}
+
+func createRevokedKeys() (rk *RevokedKeys) {
+	return &RevokedKeys{
+		certs:  make(map[string]*revokedCerts, 0),
+		keys:   make(map[string]bool, 0),
+		sha1:   make(map[string]bool, 0),
+		sha256: make(map[string]bool, 0),
+	}
+}
+
+func (rk *RevokedKeys) getCerts(ca string) (rc *revokedCerts) {
+	rc, ok := rk.certs[ca]
+	if !ok {
+		rc = &revokedCerts{
+			bitmaps: make(map[uint64]*big.Int, 0),
+			keyids:  make(map[string]bool, 0),
+		}
+		rk.certs[ca] = rc
+	}
+	return
+}
+
+func (rc *revokedCerts) isRevoked(cert *ssh.Certificate) bool {
+	for _, r := range rc.serials {
+		if cert.Serial >= r.min && cert.Serial <= r.max {
+			return true
+		}
+	}
+	for offset, bitmap := range rc.bitmaps {
+		if cert.Serial >= offset && cert.Serial-offset < uint64(bitmap.BitLen()) &&
+			bitmap.Bit(int(cert.Serial-offset)) == 1 {
+			return true
+		}
+	}
+	return rc.keyids[cert.KeyId]
+}
+
+func (rk *RevokedKeys) isKeyRevoked(key ssh.PublicKey) bool {
+	blob := key.Marshal()
+	if rk.keys[string(blob)] {
+		return true
+	}
+	s1 := sha1.Sum(blob)
+	if rk.sha1[string(s1[:])] {
+		return true
+	}
+	s256 := sha256.Sum256(blob)
+	return rk.sha256[string(s256[:])]
+}
+
+// IsRevoked checks key, and for certificate, the cert itself and its CA.
+func (rk *RevokedKeys) IsRevoked(key ssh.PublicKey) bool {
+	cert, ok := key.(*ssh.Certificate)
+	if !ok {
+		return rk.isKeyRevoked(key)
+	}
+
+	for _, ca := range []string{"", string(cert.SignatureKey.Marshal())} {
+		if rc, ok := rk.certs[ca]; ok && rc.isRevoked(cert) {
+			return true
+		}
+	}
+	return rk.isKeyRevoked(cert.Key) || rk.isKeyRevoked(cert.SignatureKey)
+}
+
+// ParseRevokedKeys reads binary KRL if data starts with KRL magic,
+// or else text lines of "serial: N[-M]", "id: keyid" or "key: pubkey".
+func ParseRevokedKeys(data []byte) (rk *RevokedKeys, err error) {
+	if len(data) >= 8 && binary.BigEndian.Uint64(data[:8]) == KRL_MAGIC {
+		return parseKRL(data)
+	}
+	return parseRevokedList(data)
+}
+
+func parseRevokedList(data []byte) (rk *RevokedKeys, err error) {
+	rk = createRevokedKeys()
+	rc := rk.getCerts("")
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		i := strings.SplitN(line, ":", 2)
+		if len(i) < 2 {
+			err = ErrRevokedKeysIllegal
+			log.Error("%s: %s", err.Error(), line)
+			return
+		}
+		value := strings.TrimSpace(i[1])
+
+		switch strings.TrimSpace(i[0]) {
+		case "serial":
+			var r serialRange
+			j := strings.SplitN(value, "-", 2)
+			r.min, err = strconv.ParseUint(j[0], 0, 64)
+			if err != nil {
+				log.Error("%s", err.Error())
+				return
+			}
+			r.max = r.min
+			if len(j) == 2 {
+				r.max, err = strconv.ParseUint(j[1], 0, 64)
+				if err != nil {
+					log.Error("%s", err.Error())
+					return
+				}
+			}
+			rc.serials = append(rc.serials, r)
+		case "id":
+			rc.keyids[value] = true
+		case "key":
+			var key ssh.PublicKey
+			key, _, _, _, err = ssh.ParseAuthorizedKey([]byte(value))
+			if err != nil {
+				log.Error("%s", err.Error())
+				return
+			}
+			rk.keys[string(key.Marshal())] = true
+		default:
+			err = ErrRevokedKeysIllegal
+			log.Error("%s: %s", err.Error(), line)
+			return
+		}
+	}
+	err = scanner.Err()
+	return
+}
+
+type krlReader struct {
+	b []byte
+}
+
+func (kr *krlReader) uint64() (i uint64, err error) {
+	if len(kr.b) < 8 {
+		return 0, ErrRevokedKeysIllegal
+	}
+	i = binary.BigEndian.Uint64(kr.b[:8])
+	kr.b = kr.b[8:]
+	return
+}
+
+func (kr *krlReader) uint32() (i uint32, err error) {
+	if len(kr.b) < 4 {
+		return 0, ErrRevokedKeysIllegal
+	}
+	i = binary.BigEndian.Uint32(kr.b[:4])
+	kr.b = kr.b[4:]
+	return
+}
+
+func (kr *krlReader) byte() (c byte, err error) {
+	if len(kr.b) < 1 {
+		return 0, ErrRevokedKeysIllegal
+	}
+	c = kr.b[0]
+	kr.b = kr.b[1:]
+	return
+}
+
+func (kr *krlReader) string() (s []byte, err error) {
+	l, err := kr.uint32()
+	if err != nil {
+		return
+	}
+	if uint32(len(kr.b)) < l {
+		return nil, ErrRevokedKeysIllegal
+	}
+	s = kr.b[:l]
+	kr.b = kr.b[l:]
+	return
+}
+
+func parseKRL(data []byte) (rk *RevokedKeys, err error) {
+	rk = createRevokedKeys()
+	kr := &krlReader{b: data[8:]}
+
+	version, err := kr.uint32()
+	if err != nil {
+		return
+	}
+	if version != KRL_FORMAT_VERSION {
+		err = ErrRevokedKeysIllegal
+		log.Error("%s: krl format version %d", err.Error(), version)
+		return
+	}
+	// krl_version, generated_date, flags, reserved, comment
+	for i := 0; i < 3; i++ {
+		_, err = kr.uint64()
+		if err != nil {
+			return
+		}
+	}
+	for i := 0; i < 2; i++ {
+		_, err = kr.string()
+		if err != nil {
+			return
+		}
+	}
+
+	for len(kr.b) > 0 {
+		var t byte
+		var section []byte
+		t, err = kr.byte()
+		if err != nil {
+			return
+		}
+		section, err = kr.string()
+		if err != nil {
+			return
+		}
+
+		sr := &krlReader{b: section}
+		switch t {
+		case KRL_SECTION_CERTIFICATES:
+			err = rk.parseKRLCerts(sr)
+		case KRL_SECTION_EXPLICIT_KEY:
+			err = sr.readSet(rk.keys)
+		case KRL_SECTION_FINGERPRINT_SHA1:
+			err = sr.readSet(rk.sha1)
+		case KRL_SECTION_FINGERPRINT_SHA256:
+			err = sr.readSet(rk.sha256)
+		case KRL_SECTION_SIGNATURES:
+		default:
+			log.Warning("unknown krl section %d", t)
+		}
+		if err != nil {
+			log.Error("%s", err.Error())
+			return
+		}
+	}
+	return
+}
+
+func (kr *krlReader) readSet(set map[string]bool) (err error) {
+	for len(kr.b) > 0 {
+		var s []byte
+		s, err = kr.string()
+		if err != nil {
+			return
+		}
+		set[string(s)] = true
+	}
+	return
+}
+
+func (rk *RevokedKeys) parseKRLCerts(kr *krlReader) (err error) {
+	ca, err := kr.string()
+	if err != nil {
+		return
+	}
+	// reserved
+	_, err = kr.string()
+	if err != nil {
+		return
+	}
+	rc := rk.getCerts(string(ca))
+
+	for len(kr.b) > 0 {
+		var t byte
+		var section []byte
+		t, err = kr.byte()
+		if err != nil {
+			return
+		}
+		section, err = kr.string()
+		if err != nil {
+			return
+		}
+
+		sr := &krlReader{b: section}
+		switch t {
+		case KRL_SECTION_CERT_SERIAL_LIST:
+			for len(sr.b) > 0 {
+				var serial uint64
+				serial, err = sr.uint64()
+				if err != nil {
+					return
+				}
+				rc.serials = append(rc.serials, serialRange{serial, serial})
+			}
+		case KRL_SECTION_CERT_SERIAL_RANGE:
+			var r serialRange
+			r.min, err = sr.uint64()
+			if err != nil {
+				return
+			}
+			r.max, err = sr.uint64()
+			if err != nil {
+				return
+			}
+			rc.serials = append(rc.serials, r)
+		case KRL_SECTION_CERT_SERIAL_BITMAP:
+			var offset uint64
+			var bitmap []byte
+			offset, err = sr.uint64()
+			if err != nil {
+				return
+			}
+			bitmap, err = sr.string()
+			if err != nil {
+				return
+			}
+			rc.bitmaps[offset] = new(big.Int).SetBytes(bitmap)
+		case KRL_SECTION_CERT_KEY_ID:
+			err = sr.readSet(rc.keyids)
+			if err != nil {
+				return
+			}
+		default:
+			log.Warning("unknown krl cert section %d", t)
+		}
+	}
+	return
+}
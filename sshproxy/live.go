@@ -0,0 +1,197 @@
+package sshproxy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// LiveTap copies output of shell channel to watchers, never blocks the user.
+type LiveTap struct {
+	chi *ChanInfo
+	// to send notice to watched user.
+	user io.Writer
+	// input of target host, for user joined.
+	target   io.Writer
+	logger   *Logger
+	mu       sync.Mutex
+	watchers map[chan []byte]struct{}
+	closed   bool
+}
+
+func CreateLiveTap(chi *ChanInfo, user, target io.Writer, l *Logger) (tap *LiveTap) {
+	tap = &LiveTap{
+		chi:      chi,
+		user:     user,
+		target:   target,
+		logger:   l,
+		watchers: make(map[chan []byte]struct{}, 0),
+	}
+	chi.ci.srv.addTap(chi.RecordLogsId, tap)
+	return
+}
+
+func (tap *LiveTap) Write(p []byte) (n int, err error) {
+	tap.mu.Lock()
+	defer tap.mu.Unlock()
+	if len(tap.watchers) == 0 {
+		return len(p), nil
+	}
+
+	b := append([]byte(nil), p...)
+	for w := range tap.watchers {
+		select {
+		case w <- b:
+		default:
+			log.Warning("live watcher too slow, data dropped.")
+		}
+	}
+	return len(p), nil
+}
+
+func (tap *LiveTap) Close() (err error) {
+	tap.chi.ci.srv.removeTap(tap.chi.RecordLogsId)
+
+	tap.mu.Lock()
+	defer tap.mu.Unlock()
+	tap.closed = true
+	tap.chi.ap.cancel()
+	for w := range tap.watchers {
+		close(w)
+	}
+	tap.watchers = nil
+	return
+}
+
+// attach returns nil if channel already closed.
+func (tap *LiveTap) attach() (w chan []byte) {
+	tap.mu.Lock()
+	if tap.closed {
+		tap.mu.Unlock()
+		return nil
+	}
+	w = make(chan []byte, 64)
+	tap.watchers[w] = struct{}{}
+	tap.mu.Unlock()
+	return
+}
+
+func (tap *LiveTap) detach(w chan []byte) {
+	tap.mu.Lock()
+	defer tap.mu.Unlock()
+	if _, ok := tap.watchers[w]; ok {
+		delete(tap.watchers, w)
+		close(w)
+	}
+}
+
+func (srv *Server) addTap(id int, tap *LiveTap) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	srv.taps[id] = tap
+}
+
+func (srv *Server) removeTap(id int) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	delete(srv.taps, id)
+}
+
+func (srv *Server) getTap(id int) (tap *LiveTap, err error) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	tap, ok := srv.taps[id]
+	if !ok {
+		return nil, ErrLiveNotFound
+	}
+	return
+}
+
+// LiveInfo attaches to output of an active shell channel, read only.
+type LiveInfo struct {
+	srv          *Server
+	Username     string
+	RecordLogsId int
+	tap          *LiveTap
+}
+
+func (li *LiveInfo) init() (err error) {
+	user, err := li.srv.GetUser(li.Username)
+	if err != nil {
+		return
+	}
+	if !user.ChkRule("audit") {
+		return ErrNoPerms
+	}
+
+	li.tap, err = li.srv.getTap(li.RecordLogsId)
+	if err != nil {
+		log.Error("%s: %d", err.Error(), li.RecordLogsId)
+		return
+	}
+
+	return li.srv.InsertAuditLogs(li.Username,
+		fmt.Sprintf("live view sess id: %d", li.RecordLogsId))
+}
+
+func (li *LiveInfo) serveChan(ch ssh.Channel, reqs <-chan *ssh.Request) {
+	defer ch.Close()
+	go AcceptRequests(reqs)
+	log.Info("live chan begin.")
+
+	w := li.tap.attach()
+	if w == nil {
+		fmt.Fprintf(ch, "session %d closed.\r\n", li.RecordLogsId)
+		return
+	}
+	defer li.tap.detach(w)
+	if li.srv.WebConfig.LiveNotice {
+		fmt.Fprintf(li.tap.user, "\r\n*** your session is watched by %s ***\r\n", li.Username)
+	}
+	fmt.Fprintf(ch, "*** watching session %d, press q to quit ***\r\n", li.RecordLogsId)
+
+	// input is ignored, except q and ctrl-c to quit.
+	go func() {
+		var b [256]byte
+		for {
+			n, err := ch.Read(b[:])
+			if err != nil || bytes.ContainsAny(b[:n], "qQ\x03") {
+				li.tap.detach(w)
+				return
+			}
+		}
+	}()
+
+	for p := range w {
+		_, err := ch.Write(p)
+		if err != nil {
+			log.Error("%s", err.Error())
+			return
+		}
+	}
+	fmt.Fprintf(ch, "\r\n*** session %d detached ***\r\n", li.RecordLogsId)
+	log.Info("live chan end.")
+}
+
+func (li *LiveInfo) Serve(srvConn *ssh.ServerConn, srvChans <-chan ssh.NewChannel, srvReqs <-chan *ssh.Request) (err error) {
+	go ssh.DiscardRequests(srvReqs)
+	log.Info("live connect begin.")
+
+	for newChan := range srvChans {
+		if newChan.ChannelType() != "session" {
+			newChan.Reject(ssh.ResourceShortage, "not session")
+			continue
+		}
+		ch, reqs, err := newChan.Accept()
+		if err != nil {
+			log.Error("%s", err.Error())
+			continue
+		}
+		go li.serveChan(ch, reqs)
+	}
+	log.Info("live connect closed.")
+	return
+}
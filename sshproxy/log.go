@@ -1,22 +1,55 @@
 package sshproxy
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/binary"
+	"encoding/json"
 	"fmt"
+	"io"
 	"os"
 	"sync"
 	"sync/atomic"
 	"time"
 )
 
+// Record file of version 1 is just chunks of [type][uint16 length][data].
+// Version 2 starts with REC_MAGIC, then [uint32 length][json RecordHeader],
+// then chunks of [type][uint32 ms since Starttime][uint16 length][data].
+const (
+	REC_MAGIC = "SSHPREC\x02"
+
+	REC_INPUT  = byte(0x01)
+	REC_OUTPUT = byte(0x02)
+	// data is [uint32 width][uint32 height]
+	REC_RESIZE = byte(0x03)
+	// input from user joined the session.
+	REC_JOIN = byte(0x04)
+)
+
+type RecordHeader struct {
+	Version      int
+	RecordId     int
+	RecordLogsId int
+	Username     string
+	Account      string
+	Host         string
+	Type         string
+	Cmd          string
+	Starttime    time.Time
+	Term         string
+	Width        uint32
+	Height       uint32
+}
+
 type Logger struct {
 	*os.File
-	mu  sync.Mutex
-	cnt int32
+	mu    sync.Mutex
+	cnt   int32
+	start time.Time
 }
 
-func CreateLogger(basedir string, t time.Time, id int) (l *Logger, err error) {
+func CreateLogger(basedir string, t time.Time, id int, hdr *RecordHeader) (l *Logger, err error) {
 	logdir := fmt.Sprintf("%s/%s", basedir, t.Format("20060102"))
 	err = os.MkdirAll(logdir, 0755)
 	if err != nil {
@@ -29,7 +62,69 @@ func CreateLogger(basedir string, t time.Time, id int) (l *Logger, err error) {
 		return
 	}
 
-	l = &Logger{File: f}
+	hdr.Version = 2
+	hdr.Starttime = time.Now()
+	b, err := json.Marshal(hdr)
+	if err != nil {
+		f.Close()
+		return
+	}
+
+	buf := bytes.NewBufferString(REC_MAGIC)
+	binary.Write(buf, binary.BigEndian, uint32(len(b)))
+	buf.Write(b)
+	_, err = f.Write(buf.Bytes())
+	if err != nil {
+		f.Close()
+		return
+	}
+
+	l = &Logger{File: f, start: hdr.Starttime}
+	return
+}
+
+// WriteChunk writes p as chunks happened at t.
+func (l *Logger) WriteChunk(b byte, t time.Time, p []byte) (n int, err error) {
+	var c int
+	var buf [7]byte
+
+	ms := t.Sub(l.start) / time.Millisecond
+	if ms < 0 {
+		ms = 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for len(p) > 0 {
+		c = len(p)
+		if c > 65535 {
+			c = 65535
+		}
+		buf[0] = b
+		binary.BigEndian.PutUint32(buf[1:], uint32(ms))
+		binary.BigEndian.PutUint16(buf[5:], uint16(c))
+
+		_, err = l.Write(buf[:])
+		if err != nil {
+			return
+		}
+
+		c, err = l.Write(p[:c])
+		if err != nil {
+			return
+		}
+
+		p = p[c:]
+		n += c
+	}
+	return
+}
+
+func (l *Logger) WriteResize(width, height uint32) (err error) {
+	var buf [8]byte
+	binary.BigEndian.PutUint32(buf[:4], width)
+	binary.BigEndian.PutUint32(buf[4:], height)
+	_, err = l.WriteChunk(REC_RESIZE, time.Now(), buf[:])
 	return
 }
 
@@ -39,6 +134,8 @@ type SubLogger struct {
 	buf *bytes.Buffer
 	mu  sync.Mutex
 	t   time.Time
+	// when data in buf happened.
+	bt time.Time
 }
 
 func (l *Logger) CreateSubLogger(b byte) (sl *SubLogger) {
@@ -51,34 +148,15 @@ func (l *Logger) CreateSubLogger(b byte) (sl *SubLogger) {
 }
 
 func (sl *SubLogger) ForceWrite(p []byte) (n int, err error) {
-	var l int
-	var buf [3]byte
-
-	for len(p) > 0 {
-		l = len(p)
-		if l > 65535 {
-			l = 65535
-		}
-		buf[0] = sl.b
-		binary.BigEndian.PutUint16(buf[1:], uint16(l))
-
-		sl.Logger.mu.Lock()
-		_, err = sl.Logger.Write(buf[:])
-		if err != nil {
-			sl.Logger.mu.Unlock()
-			return
-		}
-
-		l, err = sl.Logger.Write(p[:l])
-		if err != nil {
-			sl.Logger.mu.Unlock()
-			return
-		}
-		sl.Logger.mu.Unlock()
+	return sl.Logger.WriteChunk(sl.b, time.Now(), p)
+}
 
-		p = p[l:]
-		n += l
+func (sl *SubLogger) flush() (err error) {
+	_, err = sl.Logger.WriteChunk(sl.b, sl.bt, sl.buf.Bytes())
+	if err != nil {
+		return
 	}
+	sl.buf.Reset()
 	return
 }
 
@@ -87,14 +165,16 @@ func (sl *SubLogger) Write(p []byte) (n int, err error) {
 	defer sl.mu.Unlock()
 
 	if time.Now().Before(sl.t) {
+		if sl.buf.Len() == 0 {
+			sl.bt = time.Now()
+		}
 		return sl.buf.Write(p)
 	}
 
-	n, err = sl.ForceWrite(sl.buf.Bytes())
+	err = sl.flush()
 	if err != nil {
 		return
 	}
-	sl.buf.Reset()
 
 	n, err = sl.ForceWrite(p)
 	if err != nil {
@@ -109,11 +189,10 @@ func (sl *SubLogger) Close() (err error) {
 	sl.mu.Lock()
 	defer sl.mu.Unlock()
 
-	_, err = sl.ForceWrite(sl.buf.Bytes())
+	err = sl.flush()
 	if err != nil {
 		return
 	}
-	sl.buf.Reset()
 
 	n := atomic.AddInt32(&sl.Logger.cnt, -1)
 	if n == 0 {
@@ -121,3 +200,81 @@ func (sl *SubLogger) Close() (err error) {
 	}
 	return
 }
+
+type Chunk struct {
+	Type byte
+	// since Starttime, always 0 in version 1.
+	Time time.Duration
+	Data []byte
+}
+
+// RecordReader reads record file of both version 1 and 2.
+type RecordReader struct {
+	r      *bufio.Reader
+	Header *RecordHeader
+}
+
+func CreateRecordReader(r io.Reader) (rr *RecordReader, err error) {
+	rr = &RecordReader{
+		r:      bufio.NewReader(r),
+		Header: &RecordHeader{Version: 1},
+	}
+
+	magic, err := rr.r.Peek(len(REC_MAGIC))
+	if err != nil || string(magic) != REC_MAGIC {
+		// version 1 or empty file.
+		return rr, nil
+	}
+	rr.r.Discard(len(REC_MAGIC))
+
+	var l uint32
+	err = binary.Read(rr.r, binary.BigEndian, &l)
+	if err != nil {
+		log.Error("%s", err.Error())
+		return
+	}
+	b := make([]byte, l)
+	_, err = io.ReadFull(rr.r, b)
+	if err != nil {
+		log.Error("%s", err.Error())
+		return
+	}
+	err = json.Unmarshal(b, rr.Header)
+	if err != nil {
+		log.Error("%s", err.Error())
+		return
+	}
+	return
+}
+
+func (rr *RecordReader) ReadChunk() (c *Chunk, err error) {
+	var header [7]byte
+	var l int
+
+	c = &Chunk{}
+	switch rr.Header.Version {
+	case 1:
+		_, err = io.ReadFull(rr.r, header[:3])
+		if err != nil {
+			return nil, err
+		}
+		c.Type = header[0]
+		l = int(binary.BigEndian.Uint16(header[1:3]))
+	default:
+		_, err = io.ReadFull(rr.r, header[:])
+		if err != nil {
+			return nil, err
+		}
+		c.Type = header[0]
+		c.Time = time.Duration(binary.BigEndian.Uint32(header[1:5])) * time.Millisecond
+		l = int(binary.BigEndian.Uint16(header[5:7]))
+	}
+
+	c.Data = make([]byte, l)
+	_, err = io.ReadFull(rr.r, c.Data)
+	if err != nil {
+		log.Error("%s", err.Error())
+		return nil, err
+	}
+	return
+}
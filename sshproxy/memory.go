@@ -0,0 +1,356 @@
+package sshproxy
+
+import (
+	"encoding/base64"
+	"fmt"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/ssh"
+)
+
+type MemRecord struct {
+	Id        int
+	Username  string
+	Account   string
+	Host      string
+	Starttime time.Time
+	Endtime   time.Time
+}
+
+type MemRecordLog struct {
+	Id       int
+	RecordId int
+	Time     time.Time
+	Type     string
+	Log1     string
+	Log2     string
+	Num1     int
+	Hash     string
+}
+
+type MemAuditLog struct {
+	Time     time.Time
+	Username string
+	Log      string
+}
+
+// memCapture is capture mode and max size set on a perm.
+type memCapture struct {
+	Mode string
+	Max  int
+}
+
+// permKey is the key of settings of username on account@host.
+func permKey(username, account, host string) string {
+	return fmt.Sprintf("%s/%s@%s", username, account, host)
+}
+
+// MemBackend keeps everything in memory, for embedding and testing.
+type MemBackend struct {
+	mu       sync.Mutex
+	cfg      WebConfig
+	users    map[string]*UserInfo
+	pubkeys  map[string]string
+	accounts map[string]*AccountRslt
+	perms    map[string][]string
+	cmdrules map[string][]*CmdRule
+	dlprules map[string][]*DlpRule
+	execs    map[string][2][]string
+	captures map[string]memCapture
+	limits   map[string][2]int
+	rates    map[string][]string
+
+	Records    []*MemRecord
+	RecordLogs []*MemRecordLog
+	AuditLogs  []*MemAuditLog
+}
+
+func CreateMemBackend(cfg WebConfig) (mb *MemBackend) {
+	return &MemBackend{
+		cfg:      cfg,
+		users:    make(map[string]*UserInfo, 0),
+		pubkeys:  make(map[string]string, 0),
+		accounts: make(map[string]*AccountRslt, 0),
+		perms:    make(map[string][]string, 0),
+		cmdrules: make(map[string][]*CmdRule, 0),
+		dlprules: make(map[string][]*DlpRule, 0),
+		execs:    make(map[string][2][]string, 0),
+		captures: make(map[string]memCapture, 0),
+		limits:   make(map[string][2]int, 0),
+		rates:    make(map[string][]string, 0),
+	}
+}
+
+// AddUser adds a user with rules, such as admin and audit.
+func (mb *MemBackend) AddUser(username string, rules ...string) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	mb.users[username] = &UserInfo{Username: username, Perms: rules}
+}
+
+func (mb *MemBackend) SetPassword(username, password string) (err error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return
+	}
+
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	user, ok := mb.users[username]
+	if !ok {
+		return ErrUserNotExist
+	}
+	user.Password = string(hash)
+	return
+}
+
+// SetAuthMethods sets how username can login, empty means publickey only.
+func (mb *MemBackend) SetAuthMethods(username string, methods ...string) (err error) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	user, ok := mb.users[username]
+	if !ok {
+		return ErrUserNotExist
+	}
+	user.AuthMethods = methods
+	return
+}
+
+// SetTotpSecret enrolls username with base32 secret, empty to remove.
+func (mb *MemBackend) SetTotpSecret(username, secret string) (err error) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	user, ok := mb.users[username]
+	if !ok {
+		return ErrUserNotExist
+	}
+	user.TotpSecret = secret
+	return
+}
+
+func (mb *MemBackend) AddPubkey(username string, key ssh.PublicKey) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	mb.pubkeys[base64.StdEncoding.EncodeToString(key.Marshal())] = username
+}
+
+// AddAccount adds account on host, reached through hops in order.
+func (mb *MemBackend) AddAccount(host string, acct *AccountInfo, hops ...*HopInfo) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	mb.accounts[fmt.Sprintf("%s@%s", acct.Account, host)] = &AccountRslt{
+		AccountInfo: *acct,
+		Hops:        hops,
+	}
+}
+
+// SetPerms sets what username can do with account@host.
+func (mb *MemBackend) SetPerms(username, account, host string, perms ...string) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	mb.perms[permKey(username, account, host)] = perms
+}
+
+// SetCmdRules sets rules on commands username runs on account@host.
+func (mb *MemBackend) SetCmdRules(username, account, host string, rules ...*CmdRule) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	mb.cmdrules[permKey(username, account, host)] = rules
+}
+
+// SetDlpRules sets rules on files username transfers on account@host.
+func (mb *MemBackend) SetDlpRules(username, account, host string, rules ...*DlpRule) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	mb.dlprules[permKey(username, account, host)] = rules
+}
+
+// SetExecPatterns sets patterns of exec username can run on account@host.
+func (mb *MemBackend) SetExecPatterns(username, account, host string, allow, deny []string) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	mb.execs[permKey(username, account, host)] = [2][]string{allow, deny}
+}
+
+// SetCapture sets capture mode of files username transfers on account@host.
+func (mb *MemBackend) SetCapture(username, account, host, mode string, max int) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	mb.captures[permKey(username, account, host)] = memCapture{Mode: mode, Max: max}
+}
+
+// SetScpLimits sets largest file and quota of scp for username on account@host.
+func (mb *MemBackend) SetScpLimits(username, account, host string, maxfile, quota int) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	mb.limits[permKey(username, account, host)] = [2]int{maxfile, quota}
+}
+
+// SetRateLimits sets rate limits of username on account@host, like "scp 1m".
+func (mb *MemBackend) SetRateLimits(username, account, host string, limits ...string) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	mb.rates[permKey(username, account, host)] = limits
+}
+
+func (mb *MemBackend) GetConfig() (cfg *WebConfig, err error) {
+	cfg = &WebConfig{}
+	*cfg = mb.cfg
+	return
+}
+
+func (mb *MemBackend) GetUser(username string) (user *UserInfo, err error) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	u, ok := mb.users[username]
+	if !ok {
+		return nil, ErrUserNotExist
+	}
+	user = &UserInfo{}
+	*user = *u
+	return
+}
+
+func (mb *MemBackend) FindPubkey(key ssh.PublicKey) (username string, err error) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	username, ok := mb.pubkeys[base64.StdEncoding.EncodeToString(key.Marshal())]
+	if !ok {
+		return "", ErrIllegalPubkey
+	}
+	return
+}
+
+func (mb *MemBackend) GetAccount(username, account, host string) (rslt *AccountRslt, err error) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	if _, ok := mb.users[username]; !ok {
+		return nil, ErrUserNotExist
+	}
+	acct, ok := mb.accounts[fmt.Sprintf("%s@%s", account, host)]
+	if !ok {
+		return nil, ErrAccountNotExist
+	}
+	rslt = &AccountRslt{}
+	*rslt = *acct
+	key := permKey(username, account, host)
+	rslt.Perms = mb.perms[key]
+	rslt.CmdRules = mb.cmdrules[key]
+	rslt.DlpRules = mb.dlprules[key]
+	execs := mb.execs[key]
+	rslt.ExecAllow, rslt.ExecDeny = execs[0], execs[1]
+	limits := mb.limits[key]
+	rslt.ScpMaxFile, rslt.ScpQuota = limits[0], limits[1]
+	rslt.RateLimits = mb.rates[key]
+	c := mb.captures[key]
+	rslt.Capture, rslt.CaptureMax = c.Mode, c.Max
+	return
+}
+
+func (mb *MemBackend) GetAccounts(username string) (accounts []*AccountName, err error) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	if _, ok := mb.users[username]; !ok {
+		return nil, ErrUserNotExist
+	}
+	for key, acct := range mb.accounts {
+		host := key[len(acct.Account)+1:]
+		if len(mb.perms[permKey(username, acct.Account, host)]) == 0 {
+			continue
+		}
+		accounts = append(accounts, &AccountName{Account: acct.Account, Host: host})
+	}
+	return
+}
+
+func (mb *MemBackend) InsertRecord(username, account, host string) (recordid int, starttime time.Time, err error) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	rec := &MemRecord{
+		Id:        len(mb.Records) + 1,
+		Username:  username,
+		Account:   account,
+		Host:      host,
+		Starttime: time.Now(),
+	}
+	mb.Records = append(mb.Records, rec)
+	return rec.Id, rec.Starttime, nil
+}
+
+func (mb *MemBackend) UpdateEndtime(recordid int) (err error) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	if recordid <= 0 || recordid > len(mb.Records) {
+		return ErrRecordNotExist
+	}
+	mb.Records[recordid-1].Endtime = time.Now()
+	return
+}
+
+func (mb *MemBackend) InsertRecordLogs(recordid int, rltype, log1, log2 string, num1 int) (id int, err error) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	if recordid <= 0 || recordid > len(mb.Records) {
+		return 0, ErrRecordNotExist
+	}
+	rlog := &MemRecordLog{
+		Id:       len(mb.RecordLogs) + 1,
+		RecordId: recordid,
+		Time:     time.Now(),
+		Type:     rltype,
+		Log1:     log1,
+		Log2:     log2,
+		Num1:     num1,
+	}
+	mb.RecordLogs = append(mb.RecordLogs, rlog)
+	return rlog.Id, nil
+}
+
+func (mb *MemBackend) UpdateRecordLogsHash(recordlogid int, hash string) (err error) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	if recordlogid <= 0 || recordlogid > len(mb.RecordLogs) {
+		return ErrRecordNotExist
+	}
+	mb.RecordLogs[recordlogid-1].Hash = hash
+	return
+}
+
+func (mb *MemBackend) InsertAuditLogs(username, l string) (err error) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	mb.insertAuditLogs(username, l)
+	return
+}
+
+func (mb *MemBackend) insertAuditLogs(username, l string) {
+	log.Info("%s", l)
+	mb.AuditLogs = append(mb.AuditLogs, &MemAuditLog{
+		Time:     time.Now(),
+		Username: username,
+		Log:      l,
+	})
+}
+
+func (mb *MemBackend) CheckReview(username string, recordlogid int) (access bool, starttime time.Time, err error) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	if recordlogid <= 0 || recordlogid > len(mb.RecordLogs) {
+		return false, starttime, ErrRecordNotExist
+	}
+	rlog := mb.RecordLogs[recordlogid-1]
+	starttime = mb.Records[rlog.RecordId-1].Starttime
+
+	user, ok := mb.users[username]
+	if !ok {
+		return false, starttime, ErrUserNotExist
+	}
+	access = user.ChkRule("audit")
+	if !access {
+		return
+	}
+	mb.insertAuditLogs(username, fmt.Sprintf("view sess id: %d", recordlogid))
+	return
+}
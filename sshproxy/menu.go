@@ -0,0 +1,348 @@
+package sshproxy
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// reqQueue keeps requests of channel while menu is shown,
+// and replays them to ChanInfo after host chosen.
+type reqQueue struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	reqs   []*ssh.Request
+	closed bool
+	out    chan *ssh.Request
+}
+
+func createReqQueue(reqs <-chan *ssh.Request, pending []*ssh.Request, onReq func(*ssh.Request)) (rq *reqQueue) {
+	rq = &reqQueue{
+		reqs: pending,
+		out:  make(chan *ssh.Request),
+	}
+	rq.cond = sync.NewCond(&rq.mu)
+
+	go func() {
+		for req := range reqs {
+			onReq(req)
+			rq.mu.Lock()
+			rq.reqs = append(rq.reqs, req)
+			rq.cond.Signal()
+			rq.mu.Unlock()
+		}
+		rq.mu.Lock()
+		rq.closed = true
+		rq.cond.Signal()
+		rq.mu.Unlock()
+	}()
+	return
+}
+
+func (rq *reqQueue) start() {
+	go func() {
+		defer close(rq.out)
+		for {
+			rq.mu.Lock()
+			for len(rq.reqs) == 0 && !rq.closed {
+				rq.cond.Wait()
+			}
+			if len(rq.reqs) == 0 {
+				rq.mu.Unlock()
+				return
+			}
+			req := rq.reqs[0]
+			rq.reqs = rq.reqs[1:]
+			rq.mu.Unlock()
+			rq.out <- req
+		}
+	}()
+}
+
+// acceptedChannel is a session channel accepted by menu,
+// handed to ChanInfo as a new one. Requests replied by menu are
+// in replied, so refusal of target can be told.
+type acceptedChannel struct {
+	ch      ssh.Channel
+	rq      *reqQueue
+	replied map[*ssh.Request]bool
+}
+
+func (ac *acceptedChannel) Accept() (ssh.Channel, <-chan *ssh.Request, error) {
+	ac.rq.start()
+	return ac.ch, ac.rq.out, nil
+}
+
+func (ac *acceptedChannel) Reject(reason ssh.RejectionReason, message string) error {
+	fmt.Fprintf(ac.ch.Stderr(), "%s\r\n", message)
+	return ac.ch.Close()
+}
+
+func (ac *acceptedChannel) ChannelType() string {
+	return "session"
+}
+
+func (ac *acceptedChannel) ExtraData() []byte {
+	return nil
+}
+
+// MenuInfo lets user choose account and host after login,
+// then serves the connection as ConnInfo in the same session.
+type MenuInfo struct {
+	srv      *Server
+	Username string
+	remote   string
+	accounts []*AccountName
+
+	mu     sync.Mutex
+	height uint32
+	filter string
+	sel    int
+	errmsg string
+}
+
+func (mi *MenuInfo) init() (err error) {
+	mi.accounts, err = mi.srv.GetAccounts(mi.Username)
+	if err != nil {
+		return
+	}
+	if len(mi.accounts) == 0 {
+		err = ErrNoPerms
+		log.Error("%s: %s has no account", err.Error(), mi.Username)
+		return
+	}
+	sort.Slice(mi.accounts, func(i, j int) bool {
+		return mi.accounts[i].String() < mi.accounts[j].String()
+	})
+	mi.height = 24
+	return
+}
+
+func (mi *MenuInfo) onReq(req *ssh.Request) {
+	var height uint32
+	var err error
+	switch req.Type {
+	case "pty-req":
+		_, _, height, err = parsePtyReq(req.Payload)
+	case "window-change":
+		_, height, err = parseWindowChange(req.Payload)
+	default:
+		return
+	}
+	if err != nil || height == 0 {
+		return
+	}
+	mi.mu.Lock()
+	mi.height = height
+	mi.mu.Unlock()
+}
+
+func (mi *MenuInfo) filtered() (list []*AccountName) {
+	f := strings.ToLower(mi.filter)
+	for _, an := range mi.accounts {
+		if strings.Contains(strings.ToLower(an.String()), f) {
+			list = append(list, an)
+		}
+	}
+	return
+}
+
+func (mi *MenuInfo) draw(ch ssh.Channel) (err error) {
+	mi.mu.Lock()
+	rows := int(mi.height) - 4
+	mi.mu.Unlock()
+	if rows < 1 {
+		rows = 1
+	}
+
+	list := mi.filtered()
+	if mi.sel >= len(list) {
+		mi.sel = len(list) - 1
+	}
+	if mi.sel < 0 {
+		mi.sel = 0
+	}
+	start := 0
+	if mi.sel >= rows {
+		start = mi.sel - rows + 1
+	}
+
+	buf := bytes.NewBufferString("\x1b[H\x1b[2J")
+	fmt.Fprintf(buf, "%s, choose host: type to filter, up/down to move, enter to connect, esc to quit.\r\n",
+		mi.Username)
+	fmt.Fprintf(buf, "> %s\r\n", mi.filter)
+	for i := start; i < len(list) && i < start+rows; i++ {
+		if i == mi.sel {
+			fmt.Fprintf(buf, "\x1b[7m> %s\x1b[0m\r\n", list[i].String())
+		} else {
+			fmt.Fprintf(buf, "  %s\r\n", list[i].String())
+		}
+	}
+	if mi.errmsg != "" {
+		fmt.Fprintf(buf, "\x1b[31m%s\x1b[0m\r\n", mi.errmsg)
+	}
+	_, err = ch.Write(buf.Bytes())
+	return
+}
+
+// choose shows menu until user chooses one, nil if user quit.
+func (mi *MenuInfo) choose(ch ssh.Channel) (an *AccountName) {
+	var b [256]byte
+	for {
+		err := mi.draw(ch)
+		if err != nil {
+			return nil
+		}
+
+		n, err := ch.Read(b[:])
+		if err != nil {
+			return nil
+		}
+		for i := 0; i < n; i++ {
+			c := b[i]
+			switch {
+			case c == 0x1b && i+2 < n && (b[i+1] == '[' || b[i+1] == 'O'):
+				switch b[i+2] {
+				case 'A':
+					mi.sel--
+				case 'B':
+					mi.sel++
+				}
+				i += 2
+			case c == 0x10:
+				mi.sel--
+			case c == 0x0e:
+				mi.sel++
+			case c == 0x1b, c == 0x03, c == 0x04:
+				return nil
+			case c == '\r', c == '\n':
+				list := mi.filtered()
+				if mi.sel < len(list) {
+					return list[mi.sel]
+				}
+			case c == 0x7f, c == 0x08:
+				if len(mi.filter) > 0 {
+					mi.filter = mi.filter[:len(mi.filter)-1]
+				}
+			case c >= 0x20 && c < 0x7f:
+				mi.filter += string(c)
+				mi.sel = 0
+			}
+		}
+	}
+}
+
+// serveMenu waits for shell, then shows menu on it.
+// Channel and its requests are kept for the chosen connection.
+func (mi *MenuInfo) serveMenu(ch ssh.Channel, reqs <-chan *ssh.Request) (ci *ConnInfo, nc ssh.NewChannel) {
+	var pending []*ssh.Request
+	replied := make(map[*ssh.Request]bool, 0)
+	shell := false
+	for req := range reqs {
+		mi.onReq(req)
+		if req.Type == "exec" || req.Type == "subsystem" {
+			req.Reply(false, nil)
+			fmt.Fprintf(ch.Stderr(), "no host in login name, use account@host.\r\n")
+			ch.Close()
+			return
+		}
+		req.Reply(true, nil)
+		// replied already.
+		r := &ssh.Request{
+			Type:    req.Type,
+			Payload: req.Payload,
+		}
+		if req.WantReply {
+			replied[r] = true
+		}
+		pending = append(pending, r)
+		if req.Type == "shell" {
+			shell = true
+			break
+		}
+	}
+	if !shell {
+		ch.Close()
+		return
+	}
+	rq := createReqQueue(reqs, pending, mi.onReq)
+
+	for {
+		an := mi.choose(ch)
+		if an == nil {
+			ch.Write([]byte("\x1b[H\x1b[2J"))
+			ch.Close()
+			return
+		}
+
+		log.Notice("user %s@%s choose %s", mi.Username, mi.remote, an.String())
+		c, err := mi.srv.createConnInfo(mi.Username, an.Account, an.Host)
+		if err != nil {
+			mi.errmsg = fmt.Sprintf("%s: %s", an.String(), err.Error())
+			continue
+		}
+
+		fmt.Fprintf(ch, "\x1b[H\x1b[2Jconnecting %s...\r\n", an.String())
+		return c, &acceptedChannel{ch: ch, rq: rq, replied: replied}
+	}
+}
+
+func (mi *MenuInfo) Serve(srvConn *ssh.ServerConn, srvChans <-chan ssh.NewChannel, srvReqs <-chan *ssh.Request) (err error) {
+	log.Info("menu connect begin.")
+	defer log.Info("menu connect closed.")
+
+	// global requests, such as keepalive, are refused until host chosen.
+	greqs := make(chan *ssh.Request)
+	serving := make(chan struct{})
+	go func() {
+		defer close(greqs)
+		for req := range srvReqs {
+			select {
+			case <-serving:
+				greqs <- req
+			default:
+				req.Reply(false, nil)
+			}
+		}
+	}()
+
+	for newChan := range srvChans {
+		if newChan.ChannelType() != "session" {
+			newChan.Reject(ssh.Prohibited, "choose host first")
+			continue
+		}
+		ch, reqs, err := newChan.Accept()
+		if err != nil {
+			log.Error("%s", err.Error())
+			continue
+		}
+
+		ci, nc := mi.serveMenu(ch, reqs)
+		if ci == nil {
+			return nil
+		}
+
+		// the chosen channel comes first, then others.
+		chans := make(chan ssh.NewChannel, 1)
+		go func() {
+			chans <- nc
+			for c := range srvChans {
+				chans <- c
+			}
+			close(chans)
+		}()
+
+		close(serving)
+		err = ci.Serve(srvConn, chans, greqs)
+		if err != nil {
+			fmt.Fprintf(ch.Stderr(), "%s\r\n", err.Error())
+			ch.Close()
+		}
+		return err
+	}
+	return
+}
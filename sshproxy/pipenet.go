@@ -2,9 +2,10 @@ package sshproxy
 
 import (
 	"bytes"
-	"fmt"
 	"io"
 	"net"
+	"os"
+	"sync"
 	"text/template"
 	"time"
 
@@ -27,28 +28,182 @@ func (a *Addr) String() string {
 	return a.name
 }
 
+// deadline closes cancel when time out, like the one in net.Pipe.
+type deadline struct {
+	mu     sync.Mutex
+	timer  *time.Timer
+	cancel chan struct{}
+}
+
+func createDeadline() (d *deadline) {
+	return &deadline{cancel: make(chan struct{})}
+}
+
+func isClosedChan(c <-chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
+
+func (d *deadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.timer != nil && !d.timer.Stop() {
+		<-d.cancel
+	}
+	d.timer = nil
+
+	closed := isClosedChan(d.cancel)
+	if t.IsZero() {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		return
+	}
+
+	if dur := t.Sub(time.Now()); dur > 0 {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		d.timer = time.AfterFunc(dur, func() {
+			close(d.cancel)
+		})
+		return
+	}
+
+	if !closed {
+		close(d.cancel)
+	}
+}
+
+func (d *deadline) wait() chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.cancel
+}
+
+type ioResult struct {
+	n   int
+	err error
+}
+
+// PipeNet makes a net.Conn from reader and writer, with deadlines.
+// Read and write run in background, so they can be abandoned when time out.
 type PipeNet struct {
 	wa   Waiter
 	c    io.Closer
 	name string
 	w    io.WriteCloser
 	r    io.Reader
+
+	rmu    sync.Mutex
+	rbuf   []byte
+	rch    chan []byte
+	rerr   error
+	rdead  *deadline
+	wdead  *deadline
+	closed chan struct{}
+	once   sync.Once
+}
+
+func createPipeNet(name string, r io.Reader, w io.WriteCloser, wa Waiter, c io.Closer) (pn *PipeNet) {
+	pn = &PipeNet{
+		wa:     wa,
+		c:      c,
+		name:   name,
+		w:      w,
+		r:      r,
+		rch:    make(chan []byte),
+		rdead:  createDeadline(),
+		wdead:  createDeadline(),
+		closed: make(chan struct{}),
+	}
+	go pn.readLoop()
+	return
+}
+
+func (pn *PipeNet) readLoop() {
+	defer close(pn.rch)
+	for {
+		buf := make([]byte, 32*1024)
+		n, err := pn.r.Read(buf)
+		if n > 0 {
+			select {
+			case pn.rch <- buf[:n]:
+			case <-pn.closed:
+				return
+			}
+		}
+		if err != nil {
+			pn.rmu.Lock()
+			pn.rerr = err
+			pn.rmu.Unlock()
+			return
+		}
+	}
 }
 
 func (pn *PipeNet) Read(b []byte) (n int, err error) {
-	return pn.r.Read(b)
+	if len(pn.rbuf) == 0 {
+		select {
+		case buf, ok := <-pn.rch:
+			if !ok {
+				pn.rmu.Lock()
+				defer pn.rmu.Unlock()
+				return 0, pn.rerr
+			}
+			pn.rbuf = buf
+		case <-pn.rdead.wait():
+			return 0, os.ErrDeadlineExceeded
+		case <-pn.closed:
+			return 0, io.ErrClosedPipe
+		}
+	}
+
+	n = copy(b, pn.rbuf)
+	pn.rbuf = pn.rbuf[n:]
+	return
 }
 
 func (pn *PipeNet) Write(b []byte) (n int, err error) {
-	return pn.w.Write(b)
-}
+	select {
+	case <-pn.wdead.wait():
+		return 0, os.ErrDeadlineExceeded
+	default:
+	}
+
+	ch := make(chan ioResult, 1)
+	go func() {
+		n, err := pn.w.Write(b)
+		ch <- ioResult{n, err}
+	}()
 
-func (pn *PipeNet) Close() error {
-	pn.w.Close()
-	if pn.c != nil {
-		defer pn.c.Close()
+	select {
+	case r := <-ch:
+		return r.n, r.err
+	case <-pn.wdead.wait():
+		return 0, os.ErrDeadlineExceeded
+	case <-pn.closed:
+		return 0, io.ErrClosedPipe
 	}
-	return pn.wa.Wait()
+}
+
+func (pn *PipeNet) Close() (err error) {
+	pn.once.Do(func() {
+		close(pn.closed)
+		pn.w.Close()
+		if pn.c != nil {
+			defer pn.c.Close()
+		}
+		if pn.wa != nil {
+			err = pn.wa.Wait()
+		}
+	})
+	return
 }
 
 func (pn *PipeNet) LocalAddr() net.Addr {
@@ -60,62 +215,72 @@ func (pn *PipeNet) RemoteAddr() net.Addr {
 }
 
 func (pn *PipeNet) SetDeadline(t time.Time) error {
+	pn.rdead.set(t)
+	pn.wdead.set(t)
 	return nil
 }
 
 func (pn *PipeNet) SetReadDeadline(t time.Time) error {
+	pn.rdead.set(t)
 	return nil
 }
 
 func (pn *PipeNet) SetWriteDeadline(t time.Time) error {
+	pn.wdead.set(t)
 	return nil
 }
 
-func createPipeNet(client *ssh.Client, cmd string) (pn *PipeNet, err error) {
+// createCmdNet runs cmd on client, and use stdin and stdout as a conn.
+func createCmdNet(client *ssh.Client, cmd string) (pn *PipeNet, err error) {
 	session, err := client.NewSession()
 	if err != nil {
 		return
 	}
 
-	pn = &PipeNet{
-		wa:   session,
-		c:    client,
-		name: "ssh",
-	}
-
-	pn.w, err = session.StdinPipe()
+	w, err := session.StdinPipe()
 	if err != nil {
+		session.Close()
 		return
 	}
-	pn.r, err = session.StdoutPipe()
+	r, err := session.StdoutPipe()
 	if err != nil {
+		session.Close()
 		return
 	}
 
 	err = session.Start(cmd)
-	return
+	if err != nil {
+		session.Close()
+		return
+	}
+	return createPipeNet("ssh", r, w, session, client), nil
+}
+
+// createTcpNet opens direct-tcpip channel from client to addr.
+func createTcpNet(client *ssh.Client, addr string) (pn *PipeNet, err error) {
+	conn, err := client.Dial("tcp", addr)
+	if err != nil {
+		return
+	}
+	return createPipeNet(addr, conn, conn, nil, client), nil
 }
 
 func fmtCmd(proxycommand, desthost string, destport int) (cmd string, err error) {
-	if proxycommand != "" {
-		tmpl, err := template.New("test").Parse(proxycommand)
-		if err != nil {
-			return "", err
-		}
+	tmpl, err := template.New("test").Parse(proxycommand)
+	if err != nil {
+		return "", err
+	}
 
-		parameter := map[string]interface{}{
-			"host": desthost,
-			"port": destport,
-		}
+	parameter := map[string]interface{}{
+		"host": desthost,
+		"port": destport,
+	}
 
-		buf := bytes.NewBuffer(nil)
-		err = tmpl.Execute(buf, parameter)
-		if err != nil {
-			return "", err
-		}
-		cmd = buf.String()
-	} else {
-		cmd = fmt.Sprintf("nc %s %d", desthost, destport)
+	buf := bytes.NewBuffer(nil)
+	err = tmpl.Execute(buf, parameter)
+	if err != nil {
+		return "", err
 	}
+	cmd = buf.String()
 	return
 }
@@ -1,23 +1,42 @@
 package sshproxy
 
 import (
-	"bytes"
-	"encoding/binary"
 	"fmt"
 	"io"
-	"net/url"
 	"os"
+	"sync"
 	"time"
 
 	"golang.org/x/crypto/ssh"
 )
 
+// LogReader replays one stream of record file, in real time for version 2,
+// or at fixed pace of d for version 1. Keys written into it control playback:
+// digits set speed (0 means 10x), space pauses, left/right arrows seek
+// REVIEW_SEEK, up/down arrows seek a minute, and q quits.
+// Playback pauses at the end, so reviewer can still seek back.
+// Chunks are read one by one, seeking back reads from the beginning again.
 type LogReader struct {
-	f *os.File
-	b byte
-	d time.Duration
-	t time.Time
-	l int
+	f     *os.File
+	rr    *RecordReader
+	b     byte
+	d     time.Duration
+	total time.Duration
+
+	mu sync.Mutex
+	// next chunk of stream to play, nil at the end, n chunks read before.
+	next   *Chunk
+	n      int
+	wake   chan struct{}
+	pos    time.Duration
+	anchor time.Time
+	speed  int
+	paused bool
+	quit   bool
+	esc    []byte
+	buf    []byte
+	// when status line should be refreshed.
+	st time.Time
 }
 
 func CreateLogReader(filename string, b byte, d time.Duration) (lr *LogReader, err error) {
@@ -26,86 +45,294 @@ func CreateLogReader(filename string, b byte, d time.Duration) (lr *LogReader, e
 		log.Error("%s", err.Error())
 		return
 	}
-	log.Info("open %s for audit %d.", filename, b)
 
-	lr = &LogReader{f: f, b: b, d: d}
+	rr, err := CreateRecordReader(f)
+	if err != nil {
+		f.Close()
+		return
+	}
+	log.Info("open %s (version %d) for audit %d.", filename, rr.Header.Version, b)
+
+	lr = &LogReader{
+		f:      f,
+		rr:     rr,
+		b:      b,
+		d:      d,
+		wake:   make(chan struct{}, 1),
+		anchor: time.Now(),
+		speed:  1,
+	}
+	err = lr.scan()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
 	return
 }
 
+// readNext reads the next chunk of stream into next.
+func (lr *LogReader) readNext() (err error) {
+	for {
+		var c *Chunk
+		c, err = lr.rr.ReadChunk()
+		// record may be truncated if proxy quit unexpectedly.
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			lr.next = nil
+			return nil
+		}
+		if err != nil {
+			lr.next = nil
+			return
+		}
+		if c.Type != lr.b {
+			continue
+		}
+
+		if lr.rr.Header.Version == 1 {
+			c.Time = lr.d * time.Duration(lr.n)
+		}
+		lr.n++
+		lr.next = c
+		return
+	}
+}
+
+// rewind goes back to the first chunk of stream.
+func (lr *LogReader) rewind() (err error) {
+	_, err = lr.f.Seek(0, io.SeekStart)
+	if err != nil {
+		log.Error("%s", err.Error())
+		return
+	}
+	lr.rr, err = CreateRecordReader(lr.f)
+	if err != nil {
+		return
+	}
+	lr.n = 0
+	return lr.readNext()
+}
+
+// scan reads through stream for its length, then rewinds.
+func (lr *LogReader) scan() (err error) {
+	for err = lr.rewind(); err == nil && lr.next != nil; err = lr.readNext() {
+		lr.total = lr.next.Time
+	}
+	if err != nil {
+		return
+	}
+	return lr.rewind()
+}
+
+// play puts chunks up to pos into buf, lock must be held.
+func (lr *LogReader) play(pos time.Duration) {
+	for lr.next != nil && lr.next.Time <= pos {
+		lr.buf = append(lr.buf, lr.next.Data...)
+		err := lr.readNext()
+		if err != nil {
+			lr.quit = true
+			return
+		}
+	}
+}
+
+func (lr *LogReader) Header() *RecordHeader {
+	return lr.rr.Header
+}
+
 func (lr *LogReader) Close() (err error) {
 	log.Info("close reader")
+	lr.mu.Lock()
+	lr.quit = true
+	lr.mu.Unlock()
+	lr.notify()
 	lr.f.Close()
 	return
 }
 
-func (lr *LogReader) Write(p []byte) (n int, err error) {
-	for _, c := range p {
-		i := bytes.Index([]byte("0123456789"), []byte{c})
-		if i != -1 {
-			log.Debug("%d", i)
-		}
+func (lr *LogReader) notify() {
+	select {
+	case lr.wake <- struct{}{}:
+	default:
+	}
+}
+
+// current returns playback position, lock must be held.
+func (lr *LogReader) current() (pos time.Duration) {
+	pos = lr.pos
+	if !lr.paused {
+		pos += time.Since(lr.anchor) * time.Duration(lr.speed)
+	}
+	if pos > lr.total {
+		pos = lr.total
 	}
-	n = len(p)
 	return
 }
 
-func (lr *LogReader) load() (err error) {
-	var header [3]byte
+// setPos moves the anchor to pos, lock must be held.
+func (lr *LogReader) setPos(pos time.Duration) {
+	lr.pos = pos
+	lr.anchor = time.Now()
+}
 
-	for lr.t.After(time.Now()) {
-		time.Sleep(lr.t.Sub(time.Now()))
+// seek redraws from beginning if go backward, or skips to target if forward.
+func (lr *LogReader) seek(delta time.Duration) {
+	target := lr.current() + delta
+	if target < 0 {
+		target = 0
+	}
+	if target > lr.total {
+		target = lr.total
 	}
 
-	for {
-		_, err = io.ReadFull(lr.f, header[:])
-		if err != nil && err != io.EOF {
-			log.Error("%s", err.Error())
-		}
+	if delta < 0 {
+		err := lr.rewind()
 		if err != nil {
+			lr.quit = true
 			return
 		}
+		lr.buf = append(lr.buf[:0], "\x1bc"...)
+	}
+	lr.play(target)
+	lr.setPos(target)
+}
+
+func fmtDuration(d time.Duration) string {
+	s := int(d / time.Second)
+	return fmt.Sprintf("%02d:%02d:%02d", s/3600, s/60%60, s%60)
+}
 
-		b := header[0]
-		l := binary.BigEndian.Uint16(header[1:])
+// status draws status line at the bottom of screen, lock must be held.
+func (lr *LogReader) status() {
+	state := "play"
+	switch {
+	case lr.next == nil:
+		state = "end"
+	case lr.paused:
+		state = "pause"
+	}
+	lr.buf = append(lr.buf, fmt.Sprintf(
+		"\x1b7\x1b[999;1H\x1b[2K\x1b[7m %s / %s  %dx  %s  [0-9]speed [space]pause [<-/->]seek [q]uit \x1b[0m\x1b8",
+		fmtDuration(lr.current()), fmtDuration(lr.total), lr.speed, state)...)
+	lr.st = time.Now().Add(time.Second)
+}
 
-		if b != lr.b {
-			buf := make([]byte, l)
-			_, err = io.ReadFull(lr.f, buf)
-			if err != nil {
-				log.Error("%s", err.Error())
-				return
+func (lr *LogReader) key(c byte) {
+	switch {
+	case c >= '1' && c <= '9':
+		lr.setPos(lr.current())
+		lr.speed = int(c - '0')
+	case c == '0':
+		lr.setPos(lr.current())
+		lr.speed = 10
+	case c == ' ':
+		lr.setPos(lr.current())
+		lr.paused = !lr.paused
+	case c == 'q' || c == 'Q':
+		lr.quit = true
+	}
+}
+
+// arrow handles final byte of escape sequence like ESC [ C or ESC O C.
+func (lr *LogReader) arrow(c byte) {
+	switch c {
+	case 'A':
+		lr.seek(time.Minute)
+	case 'B':
+		lr.seek(-time.Minute)
+	case 'C':
+		lr.seek(REVIEW_SEEK)
+	case 'D':
+		lr.seek(-REVIEW_SEEK)
+	}
+}
+
+func (lr *LogReader) Write(p []byte) (n int, err error) {
+	lr.mu.Lock()
+	for _, c := range p {
+		switch {
+		case len(lr.esc) == 0 && c == 0x1b:
+			lr.esc = append(lr.esc, c)
+		case len(lr.esc) == 1:
+			if c == '[' || c == 'O' {
+				lr.esc = append(lr.esc, c)
+			} else {
+				lr.esc = lr.esc[:0]
+				lr.key(c)
 			}
-			continue
+		case len(lr.esc) >= 2:
+			// parameters of CSI, like ESC [ 1 ; 5 C.
+			if c >= 0x20 && c < 0x40 && len(lr.esc) < 16 {
+				lr.esc = append(lr.esc, c)
+				continue
+			}
+			lr.esc = lr.esc[:0]
+			lr.arrow(c)
+		default:
+			lr.key(c)
 		}
-
-		// log.Debug("reader loaded %d.", l)
-		lr.l += int(l)
-		lr.t = time.Now().Add(lr.d)
-		return
 	}
+	lr.status()
+	lr.mu.Unlock()
+	lr.notify()
+
+	n = len(p)
 	return
 }
 
 func (lr *LogReader) Read(p []byte) (n int, err error) {
-	for lr.l <= 0 {
-		err = lr.load()
-		if err != nil {
+	lr.mu.Lock()
+	defer lr.mu.Unlock()
+
+	for {
+		if lr.quit {
+			return 0, io.EOF
+		}
+
+		pos := lr.current()
+		lr.play(pos)
+		if lr.quit {
+			return 0, io.EOF
+		}
+		if lr.next == nil && !lr.paused {
+			lr.paused = true
+			lr.setPos(lr.total)
+			lr.status()
+		}
+		if len(lr.buf) > 0 && !time.Now().Before(lr.st) {
+			lr.status()
+		}
+
+		if len(lr.buf) > 0 {
+			n = copy(p, lr.buf)
+			lr.buf = lr.buf[n:]
 			return
 		}
-	}
 
-	if len(p) > lr.l {
-		p = p[:lr.l]
-	}
+		// nothing changes in pause, wait for keys.
+		wait := time.Hour
+		if !lr.paused {
+			wait = lr.st.Sub(time.Now())
+		}
+		if !lr.paused && lr.next != nil {
+			next := (lr.next.Time - pos) / time.Duration(lr.speed)
+			if next < wait {
+				wait = next
+			}
+		}
+		if wait <= 0 {
+			lr.status()
+			continue
+		}
 
-	n, err = lr.f.Read(p)
-	if err != nil {
-		log.Error("%s", err.Error())
-		return
+		lr.mu.Unlock()
+		timer := time.NewTimer(wait)
+		select {
+		case <-lr.wake:
+		case <-timer.C:
+		}
+		timer.Stop()
+		lr.mu.Lock()
 	}
-
-	lr.l -= n
-	return
 }
 
 type ReviewInfo struct {
@@ -116,28 +343,12 @@ type ReviewInfo struct {
 }
 
 func (ri *ReviewInfo) init() (err error) {
-	v := &url.Values{}
-	v.Add("username", ri.Username)
-	v.Add("recordlogid", fmt.Sprintf("%d", ri.RecordLogsId))
-
-	type ReviewRslt struct {
-		Access bool
-		Time   string
-	}
-	rslt := &ReviewRslt{}
-
-	err = ri.srv.GetJson("/l/rev", false, v, rslt)
-	if err != nil {
-		return
-	}
-
-	Starttime, err := time.Parse("2006-01-02T15:04:05", rslt.Time)
+	access, Starttime, err := ri.srv.CheckReview(ri.Username, ri.RecordLogsId)
 	if err != nil {
-		log.Error("%s", err.Error())
 		return
 	}
 
-	if !rslt.Access {
+	if !access {
 		return ErrNoPerms
 	}
 	ri.filename = fmt.Sprintf("%s/%s/%d.rec",
@@ -149,7 +360,7 @@ func (ri *ReviewInfo) serveChan(ch ssh.Channel, reqs <-chan *ssh.Request) {
 	go AcceptRequests(reqs)
 	log.Info("review chan begin.")
 
-	lr, err := CreateLogReader(ri.filename, 02, QUANTUM_SLICE)
+	lr, err := CreateLogReader(ri.filename, REC_OUTPUT, QUANTUM_SLICE)
 	if err != nil {
 		log.Error("%s", err.Error())
 		return
@@ -1,53 +1,190 @@
 package sshproxy
 
 import (
-	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path"
 	"strconv"
 	"strings"
+	"time"
 )
 
+// longest control line of scp we accept, file names included.
+const scpMaxLine = 4096
+
+// ScpFile is a file in scp stream, Path is relative to target of command.
+type ScpFile struct {
+	Path  string
+	Mode  os.FileMode
+	Size  int
+	Mtime time.Time
+	Atime time.Time
+}
+
+// FileRecorder gets files in scp stream. FileCheck returns why a file is
+// refused before anything of it passes, FileEnd is called after content.
 type FileRecorder interface {
-	FileTransmit(string, int) error
+	FileCheck(*ScpFile) (string, error)
+	FileTransmit(*ScpFile) error
 	FileData([]byte) error
+	FileEnd() error
 }
 
+const (
+	scpHeader = iota
+	scpData
+)
+
+// ScpStream follows stream from source side of scp, which is made of
+// control lines (T, C, D, E), file contents after C, and a zero status
+// byte after each content. D and E push and pop directories in -r mode.
+// A refused file is dropped, and source gets an error instead of ack,
+// so it skips to the next file. Source on target won't show the error,
+// so in download it's passed to sink on user side too.
 type ScpStream struct {
-	fr      FileRecorder
+	fr       FileRecorder
+	r        io.Reader
+	src      io.Writer
+	download bool
+	out      []byte
+	err      error
+
+	state   int
+	line    []byte
 	ignores int
+	dirs    []string
+	// times from T, for the next C or D.
+	mtime time.Time
+	atime time.Time
 }
 
-func CreateScpStream(fr FileRecorder) (ss *ScpStream) {
-	return &ScpStream{fr: fr}
+func CreateScpStream(fr FileRecorder, r io.Reader, src io.Writer, download bool) (ss *ScpStream) {
+	return &ScpStream{fr: fr, r: r, src: src, download: download}
 }
 
-func (ss *ScpStream) Write(p []byte) (n int, err error) {
-	for len(p) > 0 {
-		switch {
-		case bytes.Compare(p, []byte{0}) == 0:
-			return 1, nil
-		case ss.ignores == 0:
-			if p[0] != 'C' {
-				err = ErrScpStreamIllegal
-				log.Error("%s", err.Error())
-				return
-			}
+func (ss *ScpStream) illegal(line string) error {
+	log.Error("%s: %q", ErrScpStreamIllegal.Error(), line)
+	return ErrScpStreamIllegal
+}
 
-			meta := strings.SplitN(string(p[1:]), " ", 3)
+// parseEntry parses "mode size name" of C and D.
+func (ss *ScpStream) parseEntry(line string) (mode os.FileMode, size int, name string, err error) {
+	meta := strings.SplitN(line[1:], " ", 3)
+	if len(meta) != 3 {
+		err = ss.illegal(line)
+		return
+	}
+	m, err := strconv.ParseUint(meta[0], 8, 32)
+	if err != nil {
+		log.Error("%s", err.Error())
+		return
+	}
+	size, err = strconv.Atoi(meta[1])
+	if err != nil {
+		log.Error("%s", err.Error())
+		return
+	}
+	name = meta[2]
+	if size < 0 || name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+		err = ss.illegal(line)
+		return
+	}
+	mode = os.FileMode(m) & os.ModePerm
+	return
+}
 
-			var size int
-			size, err = strconv.Atoi(meta[1])
-			if err != nil {
-				log.Error("%s", err.Error())
-				return
-			}
+// parseTimes parses "mtime 0 atime 0" of T.
+func (ss *ScpStream) parseTimes(line string) (err error) {
+	meta := strings.Fields(line[1:])
+	if len(meta) != 4 {
+		return ss.illegal(line)
+	}
+	mtime, err := strconv.ParseInt(meta[0], 10, 64)
+	if err != nil {
+		log.Error("%s", err.Error())
+		return
+	}
+	atime, err := strconv.ParseInt(meta[2], 10, 64)
+	if err != nil {
+		log.Error("%s", err.Error())
+		return
+	}
+	ss.mtime, ss.atime = time.Unix(mtime, 0), time.Unix(atime, 0)
+	return
+}
 
-			err = ss.fr.FileTransmit(strings.Trim(meta[2], "\r\n"), size)
-			if err != nil {
-				return
+// onLine returns false if line should not be passed.
+func (ss *ScpStream) onLine(line string) (pass bool, err error) {
+	mtime, atime := ss.mtime, ss.atime
+	if line[0] != 'T' {
+		ss.mtime, ss.atime = time.Time{}, time.Time{}
+	}
+
+	switch line[0] {
+	case 'T':
+		return true, ss.parseTimes(line)
+	case 'C':
+		var sf ScpFile
+		sf.Mode, sf.Size, sf.Path, err = ss.parseEntry(line)
+		if err != nil {
+			return
+		}
+		sf.Path = path.Join(path.Join(ss.dirs...), sf.Path)
+		sf.Mtime, sf.Atime = mtime, atime
+
+		var reason string
+		reason, err = ss.fr.FileCheck(&sf)
+		if err != nil {
+			return
+		}
+		if reason != "" {
+			// answer for sink, source will go on with the next file.
+			msg := fmt.Sprintf("\x01scp: %s: %s\n", sf.Path, reason)
+			if ss.download {
+				ss.out = append(ss.out, msg...)
 			}
-			ss.ignores = size
-			return len(p), nil
-		default:
+			_, err = io.WriteString(ss.src, msg)
+			return false, err
+		}
+
+		err = ss.fr.FileTransmit(&sf)
+		if err != nil {
+			return
+		}
+		if sf.Size == 0 {
+			return true, ss.fr.FileEnd()
+		}
+		ss.state, ss.ignores = scpData, sf.Size
+	case 'D':
+		var mode os.FileMode
+		var name string
+		mode, _, name, err = ss.parseEntry(line)
+		if err != nil {
+			return
+		}
+		ss.dirs = append(ss.dirs, name)
+		log.Info("scp enter directory %s, mode: %04o", path.Join(ss.dirs...), mode)
+	case 'E':
+		if len(ss.dirs) == 0 {
+			return false, ss.illegal(line)
+		}
+		log.Info("scp leave directory %s", path.Join(ss.dirs...))
+		ss.dirs = ss.dirs[:len(ss.dirs)-1]
+	case 1, 2:
+		// warning or fatal error from source.
+		log.Warning("scp error: %s", line[1:])
+	default:
+		return false, ss.illegal(line)
+	}
+	return true, nil
+}
+
+// feed parses p, and puts what should be passed into out.
+func (ss *ScpStream) feed(p []byte) (err error) {
+	for len(p) > 0 {
+		switch {
+		case ss.state == scpData:
 			l := len(p)
 			if l > ss.ignores {
 				l = ss.ignores
@@ -56,14 +193,272 @@ func (ss *ScpStream) Write(p []byte) (n int, err error) {
 			if err != nil {
 				return
 			}
+			ss.out = append(ss.out, p[:l]...)
 			p = p[l:]
 			ss.ignores -= l
-			n += l
+			if ss.ignores == 0 {
+				ss.state = scpHeader
+				err = ss.fr.FileEnd()
+				if err != nil {
+					return
+				}
+			}
+		case len(ss.line) == 0 && p[0] == 0:
+			// status after file content.
+			ss.out = append(ss.out, 0)
+			p = p[1:]
+		default:
+			i := strings.IndexByte(string(p), '\n')
+			if i < 0 {
+				i = len(p) - 1
+			}
+			ss.line = append(ss.line, p[:i+1]...)
+			p = p[i+1:]
+
+			if ss.line[len(ss.line)-1] != '\n' {
+				if len(ss.line) > scpMaxLine {
+					return ss.illegal(string(ss.line))
+				}
+				continue
+			}
+			raw := ss.line
+			ss.line = nil
+			line := strings.TrimRight(string(raw), "\r\n")
+			if line == "" {
+				return ss.illegal(line)
+			}
+			var pass bool
+			pass, err = ss.onLine(line)
+			if err != nil {
+				return
+			}
+			if pass {
+				ss.out = append(ss.out, raw...)
+			}
+		}
+	}
+	return
+}
+
+func (ss *ScpStream) Read(p []byte) (n int, err error) {
+	for len(ss.out) == 0 {
+		if ss.err != nil {
+			return 0, ss.err
+		}
+		n, err = ss.r.Read(p)
+		e := ss.feed(p[:n])
+		if e == nil {
+			e = err
+		}
+		if e != nil {
+			ss.err = e
+			ss.end()
+		}
+	}
+	n = copy(p, ss.out)
+	ss.out = ss.out[n:]
+	return n, nil
+}
+
+// end finishes file cut in the middle.
+func (ss *ScpStream) end() {
+	if ss.state != scpData {
+		return
+	}
+	log.Warning("scp stream closed with %d bytes left", ss.ignores)
+	ss.state = scpHeader
+	err := ss.fr.FileEnd()
+	if err != nil {
+		log.Error("%s", err.Error())
+	}
+}
+
+// reserveScp counts size into bytes transferred by scp in session,
+// returns why not if file is too large or quota is used up.
+func (ci *ConnInfo) reserveScp(size int) (reason string) {
+	if ci.ScpMaxFile > 0 && size > ci.ScpMaxFile {
+		return fmt.Sprintf("file larger than %d bytes", ci.ScpMaxFile)
+	}
+
+	ci.mu.Lock()
+	defer ci.mu.Unlock()
+	if ci.ScpQuota > 0 && ci.scpBytes+size > ci.ScpQuota {
+		return fmt.Sprintf("quota of %d bytes exceeded, %d used", ci.ScpQuota, ci.scpBytes)
+	}
+	ci.scpBytes += size
+	return
+}
+
+// ScpCmd is command line of scp running on target, such as "scp -r -t dir".
+type ScpCmd struct {
+	// scpto for -t, scpfrom for -f.
+	Mode      string
+	Recursive bool
+	Preserve  bool
+	Dir       bool
+	Verbose   bool
+	Quiet     bool
+	Target    string
+	targets   []string
+}
+
+// quoteArg quotes parts of s with spaces or quotes for sh, while globs
+// and leading ~ are left to sh to expand, as scp expects.
+func quoteArg(s string) string {
+	if !strings.ContainsAny(s, " \t'\"") {
+		return s
+	}
+	var b strings.Builder
+	if strings.HasPrefix(s, "~") {
+		i := strings.IndexRune(s, '/')
+		if i == -1 {
+			i = len(s)
+		}
+		if !strings.ContainsAny(s[:i], " \t'\"") {
+			b.WriteString(s[:i])
+			s = s[i:]
+		}
+	}
+	for len(s) > 0 {
+		i := strings.IndexAny(s, "*?[]")
+		if i == -1 {
+			i = len(s)
+		}
+		if i > 0 {
+			b.WriteString("'" + strings.Replace(s[:i], "'", `'\''`, -1) + "'")
+		}
+		if i < len(s) {
+			b.WriteByte(s[i])
+			i++
+		}
+		s = s[i:]
+	}
+	return b.String()
+}
+
+// String returns command line of sc, with targets quoted for sh.
+func (sc *ScpCmd) String() string {
+	args := []string{"scp"}
+	if sc.Recursive {
+		args = append(args, "-r")
+	}
+	if sc.Preserve {
+		args = append(args, "-p")
+	}
+	if sc.Dir {
+		args = append(args, "-d")
+	}
+	if sc.Verbose {
+		args = append(args, "-v")
+	}
+	if sc.Quiet {
+		args = append(args, "-q")
+	}
+	if sc.Mode == "scpto" {
+		args = append(args, "-t")
+	} else {
+		args = append(args, "-f")
+	}
+	args = append(args, "--")
+	for _, t := range sc.targets {
+		args = append(args, quoteArg(t))
+	}
+	return strings.Join(args, " ")
+}
+
+// scpMetaChars makes sh do more than running scp, such as ";" and "$(",
+// and cmd with them is never taken as scp.
+const scpMetaChars = ";&|$`<>(){}!\\\n\r"
+
+// scpFlags are flags accepted in scp command line.
+const scpFlags = "tfrpdvq"
+
+// splitArgs splits command line like sh, with quotes. Words are separated
+// by spaces or tabs only, cmd with sh meta chars is refused before.
+func splitArgs(s string) (args []string, err error) {
+	var arg []rune
+	var quote rune
+	inArg := false
+	for _, r := range s {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+				break
+			}
+			arg = append(arg, r)
+		case r == '\'' || r == '"':
+			inArg, quote = true, r
+		case r == ' ' || r == '\t':
+			if inArg {
+				args = append(args, string(arg))
+				arg, inArg = nil, false
+			}
+		default:
+			inArg, arg = true, append(arg, r)
 		}
 	}
+	if quote != 0 {
+		err = ErrPayloadIllegal
+		log.Error("%s: unclosed quote in %s", err.Error(), s)
+		return
+	}
+	if inArg {
+		args = append(args, string(arg))
+	}
 	return
 }
 
-func (ss *ScpStream) Close() error {
-	return nil
+// ParseScpCmd parses cmd, returns nil if it's not only scp in -t or -f mode.
+func ParseScpCmd(cmd string) (sc *ScpCmd) {
+	if strings.ContainsAny(cmd, scpMetaChars) {
+		return nil
+	}
+	args, err := splitArgs(cmd)
+	if err != nil || len(args) == 0 {
+		return nil
+	}
+	if args[0] != "scp" && args[0] != "/usr/bin/scp" {
+		return nil
+	}
+
+	sc = &ScpCmd{}
+	i := 1
+	for ; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			i++
+			break
+		}
+		if !strings.HasPrefix(arg, "-") || arg == "-" {
+			break
+		}
+		for _, c := range arg[1:] {
+			switch c {
+			case 't':
+				sc.Mode = "scpto"
+			case 'f':
+				sc.Mode = "scpfrom"
+			case 'r':
+				sc.Recursive = true
+			case 'p':
+				sc.Preserve = true
+			case 'd':
+				sc.Dir = true
+			case 'v':
+				sc.Verbose = true
+			case 'q':
+				sc.Quiet = true
+			}
+			if !strings.ContainsRune(scpFlags, c) {
+				return nil
+			}
+		}
+	}
+	if sc.Mode == "" {
+		return nil
+	}
+	sc.targets = args[i:]
+	sc.Target = strings.Join(sc.targets, " ")
+	return
 }
@@ -1,17 +1,13 @@
 package sshproxy
 
 import (
-	"bytes"
-	"encoding/base64"
-	"encoding/json"
 	"fmt"
 	"net"
-	"net/http"
-	"net/url"
 	"strconv"
 	"strings"
 	"sync"
 
+	"golang.org/x/crypto/bcrypt"
 	"golang.org/x/crypto/ssh"
 )
 
@@ -19,73 +15,123 @@ type WebConfig struct {
 	Listen  string
 	Hostkey string
 	Logdir  string
+	// CA keys of user certificates, in authorized_keys format.
+	UserCA string
+	// path of KRL or revoked list.
+	RevokedKeys string
+	// private key of CA, to sign certificates for accounts.
+	AccountCA string
+	// tell user when an auditor watches the session.
+	LiveNotice bool
+	// cap of bandwidth of all channels, bytes per second, such as 10m.
+	RateLimit string
 }
 
 type Server struct {
 	WebConfig
-	webhost string
-	srvcfg  *ssh.ServerConfig
-	mu      sync.Mutex
-	scss    map[net.Addr]SshConnServer
-	cnt     *Counter
+	Backend
+	srvcfg *ssh.ServerConfig
+	ucc    *UserCertChecker
+	aca    *AccountCA
+	mu     sync.Mutex
+	scss   map[net.Addr]SshConnServer
+	taps   map[int]*LiveTap
+	holds  map[int]*Approval
+	conns  map[int]*ConnInfo
+	cnt    *Counter
+	// last totp time-step used by users.
+	steps map[string]int64
+	// global cap, nil for no limit, and buckets of users.
+	bucket  *TokenBucket
+	buckets map[string]*sharedBucket
 }
 
-func CreateServer(webhost string) (srv *Server, err error) {
+func CreateServer(backend Backend) (srv *Server, err error) {
 	srv = &Server{
+		Backend: backend,
 		scss:    make(map[net.Addr]SshConnServer, 0),
-		webhost: webhost,
+		taps:    make(map[int]*LiveTap, 0),
+		holds:   make(map[int]*Approval, 0),
+		conns:   make(map[int]*ConnInfo, 0),
 		cnt:     CreateCounter(CONN_PROTECT),
-	}
-	srv.srvcfg = &ssh.ServerConfig{
-		PublicKeyCallback: srv.authUser,
+		steps:   make(map[string]int64, 0),
+		buckets: make(map[string]*sharedBucket, 0),
 	}
 
-	v := &url.Values{}
-	err = srv.GetJson("/l/cfg", false, v, &srv.WebConfig)
+	cfg, err := backend.GetConfig()
 	if err != nil {
-		panic(err.Error())
+		log.Error("failed to get config: %s", err.Error())
+		return
 	}
+	srv.WebConfig = *cfg
 	log.Debug("config: %#v", srv.WebConfig)
 
-	private, err := ssh.ParsePrivateKey([]byte(srv.WebConfig.Hostkey))
-	if err != nil {
-		log.Error("failed to parse keyfile: %s", err.Error())
-		return
+	if cfg.RateLimit != "" {
+		var rate int
+		rate, err = ParseRate(cfg.RateLimit)
+		if err != nil {
+			return
+		}
+		srv.bucket = CreateTokenBucket(rate)
 	}
-	srv.srvcfg.AddHostKey(private)
 
+	err = srv.loadKeys(cfg)
 	return
 }
 
-func (srv *Server) GetJson(base string, post bool, v *url.Values, obj interface{}) (err error) {
-	var resp *http.Response
-	if post {
-		u := fmt.Sprintf("http://%s%s", srv.webhost, base)
-		log.Info("post url: %s", u)
-		buf := bytes.NewBufferString(v.Encode())
-		resp, err = http.Post(u, "pplication/x-www-form-urlencoded", buf)
-	} else {
-		u := fmt.Sprintf("http://%s%s?%s", srv.webhost, base, v.Encode())
-		log.Info("get url: %s", u)
-		resp, err = http.Get(u)
+// loadKeys builds hostkey, user ca and account ca from cfg.
+func (srv *Server) loadKeys(cfg *WebConfig) (err error) {
+	srvcfg := &ssh.ServerConfig{
+		PublicKeyCallback:           srv.authUser,
+		PasswordCallback:            srv.authPassword,
+		KeyboardInteractiveCallback: srv.authKeyboard,
 	}
+
+	private, err := ssh.ParsePrivateKey([]byte(cfg.Hostkey))
 	if err != nil {
-		log.Error("query failed: %s", err.Error())
+		log.Error("failed to parse keyfile: %s", err.Error())
 		return
 	}
-	defer resp.Body.Close()
+	srvcfg.AddHostKey(private)
 
-	if obj == nil {
-		return
+	var ucc *UserCertChecker
+	if cfg.UserCA != "" {
+		ucc, err = CreateUserCertChecker(cfg.UserCA, cfg.RevokedKeys)
+		if err != nil {
+			return
+		}
+	}
+
+	var aca *AccountCA
+	if cfg.AccountCA != "" {
+		aca, err = CreateAccountCA(cfg.AccountCA)
+		if err != nil {
+			return
+		}
 	}
 
-	dec := json.NewDecoder(resp.Body)
-	err = dec.Decode(&obj)
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	srv.srvcfg, srv.ucc, srv.aca = srvcfg, ucc, aca
+	return
+}
+
+// Reload gets config from backend again, and reloads hostkey and CAs.
+// Only new connections are affected.
+func (srv *Server) Reload() (err error) {
+	cfg, err := srv.GetConfig()
 	if err != nil {
-		log.Error("decode json failed: %s", err.Error())
+		log.Error("failed to get config: %s", err.Error())
 		return
 	}
-	return
+	return srv.loadKeys(cfg)
+}
+
+// keys returns ssh config and CAs in use.
+func (srv *Server) keys() (srvcfg *ssh.ServerConfig, ucc *UserCertChecker, aca *AccountCA) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return srv.srvcfg, srv.ucc, srv.aca
 }
 
 func (srv *Server) getConnInfo(remote net.Addr) (scs SshConnServer, err error) {
@@ -95,7 +141,7 @@ func (srv *Server) getConnInfo(remote net.Addr) (scs SshConnServer, err error) {
 	// get RemoteAddr from ServerConn, and get user and host from AuthUser
 	scs, ok := srv.scss[remote]
 	if !ok {
-		fmt.Printf("%v", srv.scss, remote)
+		log.Debug("%v not in %v", remote, srv.scss)
 		return nil, ErrSCSNotFound
 	}
 	return
@@ -108,7 +154,8 @@ func (srv *Server) closeConn(remote net.Addr) {
 }
 
 func (srv *Server) serveConn(nConn net.Conn) {
-	conn, chans, reqs, err := ssh.NewServerConn(nConn, srv.srvcfg)
+	srvcfg, _, _ := srv.keys()
+	conn, chans, reqs, err := ssh.NewServerConn(nConn, srvcfg)
 	if err != nil {
 		log.Error("failed to handshake: %s", err.Error())
 		srv.Failed(nConn.RemoteAddr())
@@ -133,6 +180,20 @@ func (srv *Server) serveConn(nConn net.Conn) {
 
 func (srv *Server) createSshConnServer(username, remote, account, host string) (scs SshConnServer, err error) {
 	switch {
+	case host == "_" && account == "admin":
+		log.Notice("user %s@%s wanna run admin commands", username, remote)
+
+		ai := &AdminInfo{
+			srv:      srv,
+			Username: username,
+		}
+
+		err = ai.init()
+		if err != nil {
+			return
+		}
+
+		return ai, nil
 	case host == "_":
 		log.Notice("user %s@%s wanna audit log %s", username, remote, account)
 
@@ -155,23 +216,70 @@ func (srv *Server) createSshConnServer(username, remote, account, host string) (
 		}
 
 		return ri, nil
-	default:
-		log.Notice("user %s@%s will connect %s@%s.", username, remote, account, host)
+	case host == "_live":
+		log.Notice("user %s@%s wanna watch session %s", username, remote, account)
+
+		var id int
+		id, err = strconv.Atoi(account)
+		if err != nil {
+			log.Error("%s", err.Error())
+			return
+		}
 
-		ci := &ConnInfo{
+		li := &LiveInfo{
+			srv:          srv,
+			Username:     username,
+			RecordLogsId: id,
+		}
+
+		err = li.init()
+		if err != nil {
+			return
+		}
+
+		return li, nil
+	case host == "_join":
+		log.Notice("user %s@%s wanna join session %s", username, remote, account)
+
+		var id int
+		id, err = strconv.Atoi(account)
+		if err != nil {
+			log.Error("%s", err.Error())
+			return
+		}
+
+		ji := &JoinInfo{
+			srv:          srv,
+			Username:     username,
+			RecordLogsId: id,
+		}
+
+		err = ji.init()
+		if err != nil {
+			return
+		}
+
+		return ji, nil
+	case host == "":
+		log.Notice("user %s@%s will choose host in menu", username, remote)
+
+		mi := &MenuInfo{
 			srv:      srv,
 			Username: username,
-			Account:  account,
-			Host:     host,
-			Perms:    make(map[string]int, 0),
+			remote:   remote,
 		}
 
-		err = ci.loadAccount()
+		err = mi.init()
 		if err != nil {
 			return
 		}
 
-		err = ci.insertRecord()
+		return mi, nil
+	default:
+		log.Notice("user %s@%s will connect %s@%s.", username, remote, account, host)
+
+		var ci *ConnInfo
+		ci, err = srv.createConnInfo(username, account, host)
 		if err != nil {
 			return
 		}
@@ -181,48 +289,61 @@ func (srv *Server) createSshConnServer(username, remote, account, host string) (
 	return
 }
 
-func (srv *Server) findPubkey(key ssh.PublicKey) (username string, err error) {
-	pubkey := base64.StdEncoding.EncodeToString(key.Marshal())
-	v := &url.Values{}
-	v.Add("pubkey", pubkey)
+func (srv *Server) createConnInfo(username, account, host string) (ci *ConnInfo, err error) {
+	ci = &ConnInfo{
+		srv:      srv,
+		Username: username,
+		Account:  account,
+		Host:     host,
+		Perms:    make(map[string]int, 0),
+		forwards: make(map[string]*RemoteForward, 0),
+		chans:    make(map[*ChanInfo]struct{}, 0),
+	}
 
-	type PubkeyRslt struct {
-		Name     string
-		Username string
+	err = ci.loadAccount()
+	if err != nil {
+		return
 	}
-	rslt := &PubkeyRslt{}
 
-	err = srv.GetJson("/l/pubk", false, v, rslt)
+	err = ci.insertRecord()
 	if err != nil {
 		return
 	}
-	username = rslt.Username
 	return
 }
 
-func (srv *Server) authUser(meta ssh.ConnMetadata, key ssh.PublicKey) (perm *ssh.Permissions, err error) {
-	userid := meta.User()
-	log.Debug("username from client: %s", userid)
-	remote := meta.RemoteAddr()
+// parseUserId splits login name from client into username, account and host.
+// Login name looks like [username:]account@host or [username:]account/host,
+// username is needed when user not identified by pubkey.
+// Login name without host is username only, user will choose host in menu.
+func parseUserId(userid string) (username, account, host string, err error) {
+	if i := strings.Index(userid, ":"); i != -1 {
+		username = userid[:i]
+		userid = userid[i+1:]
+	}
 
 	// split user and host from username
 	i := strings.SplitN(userid, "@", 2)
 	if len(i) < 2 {
 		i = strings.SplitN(userid, "/", 2)
 		if len(i) < 2 {
-			err = ErrIllegalUserName
-			log.Error("%s", err.Error())
+			if username == "" {
+				username = userid
+			}
+			if username == "" {
+				err = ErrIllegalUserName
+				log.Error("%s", err.Error())
+			}
 			return
 		}
 	}
-	account := i[0]
-	host := i[1]
+	account = i[0]
+	host = i[1]
+	return
+}
 
-	username, err := srv.findPubkey(key)
-	if err != nil {
-		log.Error("%s", err.Error())
-		return
-	}
+func (srv *Server) login(meta ssh.ConnMetadata, username, account, host string) (perm *ssh.Permissions, err error) {
+	remote := meta.RemoteAddr()
 
 	scs, err := srv.createSshConnServer(username, remote.String(), account, host)
 	if err != nil {
@@ -240,25 +361,199 @@ func (srv *Server) authUser(meta ssh.ConnMetadata, key ssh.PublicKey) (perm *ssh
 	return
 }
 
+// findUser gets username from certificate or pubkey.
+func (srv *Server) findUser(meta ssh.ConnMetadata, key ssh.PublicKey, name string) (username string, err error) {
+	_, ucc, _ := srv.keys()
+	if ucc != nil {
+		if cert, ok := key.(*ssh.Certificate); ok {
+			return ucc.CheckUserCert(meta, cert, name)
+		}
+		if ucc.IsRevoked(key) {
+			err = ErrIllegalPubkey
+			log.Error("%s", err.Error())
+			return
+		}
+	}
+
+	username, err = srv.FindPubkey(key)
+	if err != nil {
+		log.Error("%s", err.Error())
+		return
+	}
+	if name != "" && name != username {
+		err = ErrIllegalUserName
+		log.Error("%s", err.Error())
+		return
+	}
+	return
+}
+
+func (srv *Server) authUser(meta ssh.ConnMetadata, key ssh.PublicKey) (perm *ssh.Permissions, err error) {
+	userid := meta.User()
+	log.Debug("username from client: %s", userid)
+
+	name, account, host, err := parseUserId(userid)
+	if err != nil {
+		return
+	}
+
+	username, err := srv.findUser(meta, key, name)
+	if err != nil {
+		return
+	}
+
+	user, err := srv.GetUser(username)
+	if err != nil {
+		log.Error("%s", err.Error())
+		return
+	}
+	if !user.ChkAuthMethod("publickey") {
+		err = ErrAuthMethod
+		log.Error("%s", err.Error())
+		return
+	}
+
+	return srv.loginUser(meta, user, account, host)
+}
+
+// loginUser logs user in after first factor, or asks totp if user has it.
+func (srv *Server) loginUser(meta ssh.ConnMetadata, user *UserInfo, account, host string) (perm *ssh.Permissions, err error) {
+	if user.TotpSecret != "" {
+		log.Info("user %s need totp.", user.Username)
+		return nil, &ssh.PartialSuccessError{
+			Next: ssh.ServerAuthCallbacks{
+				KeyboardInteractiveCallback: srv.authTotp(user, account, host),
+			},
+		}
+	}
+
+	return srv.login(meta, user.Username, account, host)
+}
+
+// authTotp asks verification code as second factor after pubkey.
+func (srv *Server) authTotp(user *UserInfo, account, host string) func(ssh.ConnMetadata, ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+	return func(meta ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (perm *ssh.Permissions, err error) {
+		remote := meta.RemoteAddr()
+		err = srv.Protect(remote)
+		if err != nil {
+			log.Error("%s", err.Error())
+			return
+		}
+
+		answers, err := client("", "", []string{"Verification code: "}, []bool{false})
+		if err != nil {
+			log.Error("%s", err.Error())
+			return
+		}
+
+		var step int64
+		if len(answers) == 1 {
+			step, err = CheckTotp(user.TotpSecret, answers[0])
+			if err != nil {
+				return
+			}
+		}
+		ok := step != 0 && srv.useTotpStep(user.Username, step)
+
+		if !ok {
+			srv.Failed(remote)
+			err = srv.InsertAuditLogs(user.Username,
+				fmt.Sprintf("totp failed from %s", remote.String()))
+			if err != nil {
+				log.Error("%s", err.Error())
+			}
+			err = ErrTotpNotMatch
+			log.Error("%s: %s", err.Error(), user.Username)
+			return
+		}
+
+		err = srv.InsertAuditLogs(user.Username,
+			fmt.Sprintf("totp ok from %s", remote.String()))
+		if err != nil {
+			return
+		}
+		return srv.login(meta, user.Username, account, host)
+	}
+}
+
+func (srv *Server) checkPassword(meta ssh.ConnMetadata, method, password string) (perm *ssh.Permissions, err error) {
+	userid := meta.User()
+	log.Debug("username from client: %s, method: %s", userid, method)
+
+	username, account, host, err := parseUserId(userid)
+	if err != nil {
+		return
+	}
+	if username == "" {
+		err = ErrIllegalUserName
+		log.Error("%s", err.Error())
+		return
+	}
+
+	user, err := srv.GetUser(username)
+	if err != nil {
+		log.Error("%s", err.Error())
+		return
+	}
+	if !user.ChkAuthMethod(method) {
+		err = ErrAuthMethod
+		log.Error("%s", err.Error())
+		return
+	}
+
+	err = bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password))
+	if err != nil {
+		err = ErrPasswordNotMatch
+		log.Error("%s: %s", err.Error(), username)
+		return
+	}
+
+	return srv.loginUser(meta, user, account, host)
+}
+
+func (srv *Server) authPassword(meta ssh.ConnMetadata, password []byte) (perm *ssh.Permissions, err error) {
+	return srv.checkPassword(meta, "password", string(password))
+}
+
+func (srv *Server) authKeyboard(meta ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (perm *ssh.Permissions, err error) {
+	answers, err := client("", "", []string{"Password: "}, []bool{false})
+	if err != nil {
+		log.Error("%s", err.Error())
+		return
+	}
+	if len(answers) != 1 {
+		err = ErrPasswordNotMatch
+		log.Error("%s", err.Error())
+		return
+	}
+	return srv.checkPassword(meta, "keyboard-interactive", answers[0])
+}
+
 func (srv *Server) Protect(addr net.Addr) (err error) {
 	taddr, ok := addr.(*net.TCPAddr)
 	if !ok {
 		return
 	}
-	s := string(taddr.IP)
-	if srv.cnt.Number(s) > MAX_FAILED {
+	if srv.cnt.Number(ipKey(taddr.IP)) > MAX_FAILED {
 		return ErrFailedTooMany
 	}
 	return
 }
 
+// ipKey is the key of ip in counter, ipv4 in ipv6 form is the same as ipv4.
+func ipKey(ip net.IP) string {
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+	}
+	return string(ip)
+}
+
 func (srv *Server) Failed(addr net.Addr) {
 	taddr, ok := addr.(*net.TCPAddr)
 	if !ok {
 		return
 	}
-	s := string(taddr.IP)
-	srv.cnt.Add(s, 1)
+	srv.cnt.Add(ipKey(taddr.IP), 1)
 }
 
 func (srv *Server) MainLoop() {
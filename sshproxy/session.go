@@ -0,0 +1,135 @@
+package sshproxy
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// addConn registers ci as active, after connected to target.
+func (srv *Server) addConn(ci *ConnInfo) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	srv.conns[ci.RecordId] = ci
+}
+
+func (srv *Server) removeConn(id int) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	delete(srv.conns, id)
+}
+
+func (srv *Server) getConn(id int) (ci *ConnInfo, err error) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	ci, ok := srv.conns[id]
+	if !ok {
+		return nil, ErrSessionNotFound
+	}
+	return
+}
+
+// Conns returns all active connections, sorted by record id.
+func (srv *Server) Conns() (cis []*ConnInfo) {
+	srv.mu.Lock()
+	for _, ci := range srv.conns {
+		cis = append(cis, ci)
+	}
+	srv.mu.Unlock()
+
+	sort.Slice(cis, func(i, j int) bool {
+		return cis[i].RecordId < cis[j].RecordId
+	})
+	return
+}
+
+// Kill disconnects session id after d, and warns user first if d > 0.
+func (srv *Server) Kill(id int, d time.Duration) (err error) {
+	ci, err := srv.getConn(id)
+	if err != nil {
+		log.Error("%s: %d", err.Error(), id)
+		return
+	}
+	if d <= 0 {
+		log.Notice("session %d killed.", id)
+		return ci.Close()
+	}
+
+	ci.Message(fmt.Sprintf("this session will be closed in %s.", d))
+	time.AfterFunc(d, func() {
+		log.Notice("session %d killed.", id)
+		ci.Close()
+	})
+	return
+}
+
+// Broadcast sends msg to shells of session id, or all sessions if id is 0.
+// Returns how many shells got it.
+func (srv *Server) Broadcast(id int, msg string) (n int, err error) {
+	if id != 0 {
+		var ci *ConnInfo
+		ci, err = srv.getConn(id)
+		if err != nil {
+			log.Error("%s: %d", err.Error(), id)
+			return
+		}
+		return ci.Message(msg), nil
+	}
+
+	for _, ci := range srv.Conns() {
+		n += ci.Message(msg)
+	}
+	return
+}
+
+func (ci *ConnInfo) addChan(chi *ChanInfo) {
+	ci.mu.Lock()
+	defer ci.mu.Unlock()
+	ci.chans[chi] = struct{}{}
+}
+
+func (ci *ConnInfo) removeChan(chi *ChanInfo) {
+	ci.mu.Lock()
+	defer ci.mu.Unlock()
+	delete(ci.chans, chi)
+}
+
+// Chans returns active channels, sorted by start time.
+func (ci *ConnInfo) Chans() (chis []*ChanInfo) {
+	ci.mu.Lock()
+	for chi := range ci.chans {
+		chis = append(chis, chi)
+	}
+	ci.mu.Unlock()
+
+	sort.Slice(chis, func(i, j int) bool {
+		return chis[i].Starttime.Before(chis[j].Starttime)
+	})
+	return
+}
+
+// Bytes returns bytes from and to user of session, closed channels included.
+func (ci *ConnInfo) Bytes() (in, out int64) {
+	return ci.In.Count(), ci.Out.Count()
+}
+
+// Message writes msg to every shell of user, returns how many shells got it.
+func (ci *ConnInfo) Message(msg string) (n int) {
+	for _, chi := range ci.Chans() {
+		chi.mu.Lock()
+		tap := chi.tap
+		chi.mu.Unlock()
+		if tap == nil {
+			continue
+		}
+
+		_, err := fmt.Fprintf(tap.user, "\r\n*** %s ***\r\n", msg)
+		if err != nil {
+			log.Error("%s", err.Error())
+			continue
+		}
+		n++
+	}
+	log.Notice("message to session %d: %s", ci.RecordId, msg)
+	return
+}
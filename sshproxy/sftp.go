@@ -0,0 +1,436 @@
+package sshproxy
+
+import (
+	"encoding/binary"
+	"io"
+	"sync"
+)
+
+// packet types of sftp v3.
+const (
+	SSH_FXP_INIT     = 1
+	SSH_FXP_VERSION  = 2
+	SSH_FXP_OPEN     = 3
+	SSH_FXP_CLOSE    = 4
+	SSH_FXP_READ     = 5
+	SSH_FXP_WRITE    = 6
+	SSH_FXP_LSTAT    = 7
+	SSH_FXP_FSTAT    = 8
+	SSH_FXP_SETSTAT  = 9
+	SSH_FXP_FSETSTAT = 10
+	SSH_FXP_OPENDIR  = 11
+	SSH_FXP_READDIR  = 12
+	SSH_FXP_REMOVE   = 13
+	SSH_FXP_MKDIR    = 14
+	SSH_FXP_RMDIR    = 15
+	SSH_FXP_REALPATH = 16
+	SSH_FXP_STAT     = 17
+	SSH_FXP_RENAME   = 18
+	SSH_FXP_READLINK = 19
+	SSH_FXP_SYMLINK  = 20
+	SSH_FXP_STATUS   = 101
+	SSH_FXP_HANDLE   = 102
+	SSH_FXP_DATA     = 103
+	SSH_FXP_EXTENDED = 200
+)
+
+const (
+	SSH_FXF_READ   = 0x01
+	SSH_FXF_WRITE  = 0x02
+	SSH_FXF_APPEND = 0x04
+	SSH_FXF_CREAT  = 0x08
+	SSH_FXF_TRUNC  = 0x10
+
+	SSH_FX_PERMISSION_DENIED = 3
+)
+
+// extensions of openssh which change files.
+var sftpWriteExtensions = map[string]bool{
+	"posix-rename@openssh.com": true,
+	"hardlink@openssh.com":     true,
+	"lsetstat@openssh.com":     true,
+	"fsetstat@openssh.com":     true,
+	"copy-data":                true,
+}
+
+type sftpFile struct {
+	path    string
+	flags   uint32
+	read    int
+	written int
+}
+
+func (sf *sftpFile) writing() bool {
+	return sf.flags&(SSH_FXF_WRITE|SSH_FXF_APPEND|SSH_FXF_CREAT|SSH_FXF_TRUNC) != 0
+}
+
+// SftpStream sits on both directions of sftp channel.
+// Requests from user are read by Read, checked with scpfrom and scpto,
+// and refused ones are answered with permission denied. Responses from
+// server are written by Write, to follow handles and sizes of files.
+// Open files are recorded when closed, others are recorded when requested.
+type SftpStream struct {
+	chi  *ChanInfo
+	r    io.Reader
+	user io.WriteCloser
+
+	// writes to user, responses of server and refused requests.
+	wmu  sync.Mutex
+	rbuf []byte
+	wbuf []byte
+	out  []byte
+	err  error
+
+	mu      sync.Mutex
+	opens   map[uint32]*sftpFile
+	reads   map[uint32]*sftpFile
+	handles map[string]*sftpFile
+}
+
+func CreateSftpStream(chi *ChanInfo, r io.Reader, user io.WriteCloser) (ss *SftpStream) {
+	return &SftpStream{
+		chi:     chi,
+		r:       r,
+		user:    user,
+		opens:   make(map[uint32]*sftpFile, 0),
+		reads:   make(map[uint32]*sftpFile, 0),
+		handles: make(map[string]*sftpFile, 0),
+	}
+}
+
+// cutPacket returns the first whole packet in buf, nil if not yet.
+func cutPacket(buf []byte) (pkt, rest []byte, err error) {
+	if len(buf) < 4 {
+		return nil, buf, nil
+	}
+	size := binary.BigEndian.Uint32(buf[:4])
+	if size == 0 || size > SFTP_MAX_PACKET {
+		err = ErrSftpIllegal
+		log.Error("%s: packet size %d", err.Error(), size)
+		return
+	}
+	if uint32(len(buf)-4) < size {
+		return nil, buf, nil
+	}
+	return buf[:4+size], buf[4+size:], nil
+}
+
+func (ss *SftpStream) record(rltype, log1, log2 string, num1 int) {
+	log.Notice("sftp %s: %s %s %d", rltype, log1, log2, num1)
+	_, err := ss.chi.insertRecordLogs(rltype, log1, log2, num1)
+	if err != nil {
+		log.Error("%s", err.Error())
+	}
+}
+
+func (ss *SftpStream) recordFile(sf *sftpFile) {
+	if sf.read > 0 || !sf.writing() {
+		ss.record("sftpfrom", sf.path, "", sf.read)
+	}
+	if sf.writing() {
+		ss.record("sftpto", sf.path, "", sf.written)
+	}
+}
+
+// deny answers id with permission denied, returns reason if refused.
+func (ss *SftpStream) deny(id uint32, perm, op, path string) (refused bool, err error) {
+	if ss.chi.ci.ChkPerm(perm) {
+		return false, nil
+	}
+
+	reason := "no " + perm + " perm"
+	log.Error("sftp %s %s refused: %s", op, path, reason)
+	ss.record("refuse", "sftp "+op+" "+path, reason, 0)
+
+	msg := "permission denied"
+	b := make([]byte, 4+1+4+4+4+len(msg)+4)
+	binary.BigEndian.PutUint32(b[0:], uint32(len(b)-4))
+	b[4] = SSH_FXP_STATUS
+	binary.BigEndian.PutUint32(b[5:], id)
+	binary.BigEndian.PutUint32(b[9:], SSH_FX_PERMISSION_DENIED)
+	binary.BigEndian.PutUint32(b[13:], uint32(len(msg)))
+	copy(b[17:], msg)
+
+	ss.wmu.Lock()
+	defer ss.wmu.Unlock()
+	_, err = ss.user.Write(b)
+	return true, err
+}
+
+// onRequest returns false if packet should not go to server.
+func (ss *SftpStream) onRequest(pkt []byte) (pass bool, err error) {
+	t, d := pkt[4], pkt[5:]
+	if t == SSH_FXP_INIT {
+		return true, nil
+	}
+	id, d, err := ReadPayloadUint32(d)
+	if err != nil {
+		log.Error("%s", err.Error())
+		return
+	}
+
+	var s1, s2 string
+	var flags uint32
+	switch t {
+	case SSH_FXP_OPEN:
+		s1, d, err = ReadPayloadString(d)
+		if err != nil {
+			break
+		}
+		flags, d, err = ReadPayloadUint32(d)
+		if err != nil {
+			break
+		}
+		sf := &sftpFile{path: s1, flags: flags}
+		if flags&SSH_FXF_READ != 0 || !sf.writing() {
+			if refused, err := ss.deny(id, "scpfrom", "open", s1); refused || err != nil {
+				return false, err
+			}
+		}
+		if sf.writing() {
+			if refused, err := ss.deny(id, "scpto", "open", s1); refused || err != nil {
+				return false, err
+			}
+		}
+		ss.mu.Lock()
+		ss.opens[id] = sf
+		ss.mu.Unlock()
+	case SSH_FXP_READ:
+		s1, d, err = ReadPayloadString(d)
+		if err != nil {
+			break
+		}
+		ss.mu.Lock()
+		if sf, ok := ss.handles[s1]; ok {
+			ss.reads[id] = sf
+		}
+		ss.mu.Unlock()
+	case SSH_FXP_WRITE:
+		s1, d, err = ReadPayloadString(d)
+		if err != nil {
+			break
+		}
+		if len(d) < 8 {
+			err = ErrSftpIllegal
+			break
+		}
+		s2, d, err = ReadPayloadString(d[8:])
+		if err != nil {
+			break
+		}
+		ss.mu.Lock()
+		if sf, ok := ss.handles[s1]; ok {
+			sf.written += len(s2)
+		}
+		ss.mu.Unlock()
+	case SSH_FXP_CLOSE:
+		s1, d, err = ReadPayloadString(d)
+		if err != nil {
+			break
+		}
+		ss.mu.Lock()
+		sf, ok := ss.handles[s1]
+		delete(ss.handles, s1)
+		ss.mu.Unlock()
+		if ok {
+			ss.recordFile(sf)
+		}
+	case SSH_FXP_REMOVE, SSH_FXP_MKDIR, SSH_FXP_RMDIR, SSH_FXP_SETSTAT:
+		s1, d, err = ReadPayloadString(d)
+		if err != nil {
+			break
+		}
+		op := map[byte]string{
+			SSH_FXP_REMOVE:  "rm",
+			SSH_FXP_MKDIR:   "mkdir",
+			SSH_FXP_RMDIR:   "rmdir",
+			SSH_FXP_SETSTAT: "setstat",
+		}[t]
+		if refused, err := ss.deny(id, "scpto", op, s1); refused || err != nil {
+			return false, err
+		}
+		ss.record("sftp"+op, s1, "", 0)
+	case SSH_FXP_FSETSTAT:
+		s1, d, err = ReadPayloadString(d)
+		if err != nil {
+			break
+		}
+		ss.mu.Lock()
+		if sf, ok := ss.handles[s1]; ok {
+			s1 = sf.path
+		}
+		ss.mu.Unlock()
+		if refused, err := ss.deny(id, "scpto", "setstat", s1); refused || err != nil {
+			return false, err
+		}
+		ss.record("sftpsetstat", s1, "", 0)
+	case SSH_FXP_RENAME, SSH_FXP_SYMLINK:
+		s1, d, err = ReadPayloadString(d)
+		if err != nil {
+			break
+		}
+		s2, d, err = ReadPayloadString(d)
+		if err != nil {
+			break
+		}
+		op := "mv"
+		if t == SSH_FXP_SYMLINK {
+			op = "ln"
+		}
+		if refused, err := ss.deny(id, "scpto", op, s1); refused || err != nil {
+			return false, err
+		}
+		ss.record("sftp"+op, s1, s2, 0)
+	case SSH_FXP_EXTENDED:
+		s1, d, err = ReadPayloadString(d)
+		if err != nil {
+			break
+		}
+		if !sftpWriteExtensions[s1] {
+			break
+		}
+		strs, _ := ReadPayloads(d)
+		path := ""
+		if len(strs) > 0 {
+			path = strs[0]
+		}
+		if refused, err := ss.deny(id, "scpto", s1, path); refused || err != nil {
+			return false, err
+		}
+		ss.record("sftpext", s1, path, 0)
+	}
+	if err != nil {
+		log.Error("%s", err.Error())
+		return
+	}
+	return true, nil
+}
+
+// onResponse follows handles of files, and bytes read.
+func (ss *SftpStream) onResponse(pkt []byte) (err error) {
+	t, d := pkt[4], pkt[5:]
+	if t == SSH_FXP_VERSION {
+		return
+	}
+	id, d, err := ReadPayloadUint32(d)
+	if err != nil {
+		log.Error("%s", err.Error())
+		return
+	}
+
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	switch t {
+	case SSH_FXP_HANDLE:
+		sf, ok := ss.opens[id]
+		if !ok {
+			break
+		}
+		delete(ss.opens, id)
+		var handle string
+		handle, _, err = ReadPayloadString(d)
+		if err != nil {
+			log.Error("%s", err.Error())
+			return
+		}
+		ss.handles[handle] = sf
+	case SSH_FXP_DATA:
+		sf, ok := ss.reads[id]
+		if !ok {
+			break
+		}
+		delete(ss.reads, id)
+		var data string
+		data, _, err = ReadPayloadString(d)
+		if err != nil {
+			log.Error("%s", err.Error())
+			return
+		}
+		sf.read += len(data)
+	case SSH_FXP_STATUS:
+		delete(ss.opens, id)
+		delete(ss.reads, id)
+	}
+	return
+}
+
+func (ss *SftpStream) Read(p []byte) (n int, err error) {
+	for len(ss.out) == 0 {
+		if ss.err != nil {
+			return 0, ss.err
+		}
+		n, err = ss.r.Read(p)
+		ss.rbuf = append(ss.rbuf, p[:n]...)
+		if err != nil {
+			ss.err = err
+		}
+
+		for {
+			var pkt []byte
+			var e error
+			pkt, ss.rbuf, e = cutPacket(ss.rbuf)
+			if e != nil {
+				ss.err = e
+				break
+			}
+			if pkt == nil {
+				break
+			}
+			pass, e := ss.onRequest(pkt)
+			if e != nil {
+				ss.err = e
+				break
+			}
+			if pass {
+				ss.out = append(ss.out, pkt...)
+			}
+		}
+	}
+	n = copy(p, ss.out)
+	ss.out = ss.out[n:]
+	return n, nil
+}
+
+// Write passes whole packets of server to user.
+func (ss *SftpStream) Write(p []byte) (n int, err error) {
+	ss.wbuf = append(ss.wbuf, p...)
+	var pkts []byte
+	for {
+		var pkt []byte
+		pkt, ss.wbuf, err = cutPacket(ss.wbuf)
+		if err != nil {
+			return
+		}
+		if pkt == nil {
+			break
+		}
+		err = ss.onResponse(pkt)
+		if err != nil {
+			return
+		}
+		pkts = append(pkts, pkt...)
+	}
+	if len(pkts) == 0 {
+		return len(p), nil
+	}
+
+	ss.wmu.Lock()
+	defer ss.wmu.Unlock()
+	_, err = ss.user.Write(pkts)
+	if err != nil {
+		return
+	}
+	return len(p), nil
+}
+
+// Close records files not closed, and closes user.
+func (ss *SftpStream) Close() error {
+	ss.mu.Lock()
+	handles := ss.handles
+	ss.handles = make(map[string]*sftpFile, 0)
+	ss.mu.Unlock()
+	for _, sf := range handles {
+		ss.recordFile(sf)
+	}
+	return ss.user.Close()
+}
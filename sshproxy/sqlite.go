@@ -0,0 +1,570 @@
+package sshproxy
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// SqliteBackend reads and writes the database created by web/db.py.
+// The sqlite3 driver should be imported by main.
+type SqliteBackend struct {
+	db  *sql.DB
+	cfg WebConfig
+}
+
+func CreateSqliteBackend(dbfile string, cfg WebConfig) (sb *SqliteBackend, err error) {
+	db, err := sql.Open("sqlite3", dbfile)
+	if err != nil {
+		log.Error("%s", err.Error())
+		return
+	}
+	// sqlite don't like concurrent writers.
+	db.SetMaxOpenConns(1)
+
+	err = db.Ping()
+	if err != nil {
+		log.Error("%s", err.Error())
+		return
+	}
+	sb = &SqliteBackend{db: db, cfg: cfg}
+	return
+}
+
+func (sb *SqliteBackend) Close() (err error) {
+	return sb.db.Close()
+}
+
+func (sb *SqliteBackend) GetConfig() (cfg *WebConfig, err error) {
+	cfg = &WebConfig{}
+	*cfg = sb.cfg
+	return
+}
+
+func (sb *SqliteBackend) FindPubkey(key ssh.PublicKey) (username string, err error) {
+	pubkey := base64.StdEncoding.EncodeToString(key.Marshal())
+	err = sb.db.QueryRow(
+		"SELECT username FROM pubkeys WHERE pubkey=?", pubkey).Scan(&username)
+	if err == sql.ErrNoRows {
+		err = ErrIllegalPubkey
+	}
+	if err != nil {
+		log.Error("%s", err.Error())
+		return
+	}
+	return
+}
+
+func (sb *SqliteBackend) GetUser(username string) (user *UserInfo, err error) {
+	var perms, authmethods, totp sql.NullString
+	user = &UserInfo{}
+	err = sb.db.QueryRow(
+		"SELECT username, password, perms, authmethods, totp FROM users WHERE username=?",
+		username).Scan(&user.Username, &user.Password, &perms, &authmethods, &totp)
+	if err == sql.ErrNoRows {
+		err = ErrUserNotExist
+	}
+	if err != nil {
+		log.Error("%s", err.Error())
+		return nil, err
+	}
+	user.Perms = splitPerms(perms.String)
+	user.AuthMethods = splitPerms(authmethods.String)
+	user.TotpSecret = totp.String
+	return
+}
+
+func (sb *SqliteBackend) getAccountInfo(where string, args ...interface{}) (ai *AccountInfo, proxyid sql.NullInt64, proxycommand sql.NullString, err error) {
+	var key, password, hostkeys sql.NullString
+	var sensitive sql.NullBool
+	ai = &AccountInfo{}
+	err = sb.db.QueryRow(`SELECT h.id, h.hostname, h.port, h.hostkeys, h.sensitive,
+a.id, a.account, a.key, a.password, h.proxyaccount, h.proxycommand
+FROM accounts a JOIN hosts h ON a.hostid=h.id WHERE `+where, args...).Scan(
+		&ai.Hostid, &ai.Hostname, &ai.Port, &hostkeys, &sensitive,
+		&ai.Accountid, &ai.Account, &key, &password, &proxyid, &proxycommand)
+	if err == sql.ErrNoRows {
+		err = ErrAccountNotExist
+	}
+	if err != nil {
+		log.Error("%s", err.Error())
+		return
+	}
+	ai.HostKey = hostkeys.String
+	ai.Key = key.String
+	ai.Password = password.String
+	ai.Sensitive = sensitive.Bool
+	return
+}
+
+func (sb *SqliteBackend) GetAccount(username, account, host string) (rslt *AccountRslt, err error) {
+	_, err = sb.GetUser(username)
+	if err != nil {
+		return
+	}
+
+	ai, proxyid, proxycommand, err := sb.getAccountInfo(
+		"a.account=? AND h.host=?", account, host)
+	if err != nil {
+		return
+	}
+	rslt = &AccountRslt{AccountInfo: *ai}
+
+	// follow proxy account of host, until a host without proxy.
+	for proxyid.Valid {
+		if len(rslt.Hops) >= MAX_HOPS {
+			err = ErrTooManyHops
+			log.Error("%s", err.Error())
+			return
+		}
+
+		hop := &HopInfo{ProxyCommand: proxycommand.String}
+		ai, proxyid, proxycommand, err = sb.getAccountInfo("a.id=?", proxyid.Int64)
+		if err != nil {
+			return
+		}
+		hop.AccountInfo = *ai
+		rslt.Hops = append([]*HopInfo{hop}, rslt.Hops...)
+	}
+
+	rslt.Perms, err = sb.calGroup(username, rslt.Accountid)
+	if err != nil {
+		return
+	}
+	err = sb.calRules(rslt, username)
+	return
+}
+
+func (sb *SqliteBackend) GetAccounts(username string) (accounts []*AccountName, err error) {
+	_, err = sb.GetUser(username)
+	if err != nil {
+		return
+	}
+
+	rows, err := sb.db.Query(`SELECT a.id, a.account, h.host
+FROM accounts a JOIN hosts h ON a.hostid=h.id ORDER BY h.host, a.account`)
+	if err != nil {
+		log.Error("%s", err.Error())
+		return
+	}
+	var ids []int
+	var all []*AccountName
+	for rows.Next() {
+		var id int
+		an := &AccountName{}
+		err = rows.Scan(&id, &an.Account, &an.Host)
+		if err != nil {
+			rows.Close()
+			log.Error("%s", err.Error())
+			return
+		}
+		ids = append(ids, id)
+		all = append(all, an)
+	}
+	rows.Close()
+
+	for i, an := range all {
+		var perms []string
+		perms, err = sb.calGroup(username, ids[i])
+		if err != nil {
+			return
+		}
+		if len(perms) != 0 {
+			accounts = append(accounts, an)
+		}
+	}
+	return
+}
+
+type sqliteGroup struct {
+	perms     []string
+	cmdrules  string
+	dlprules  string
+	execallow string
+	execdeny  string
+	capture   string
+	// max size to capture, 0 for no limit.
+	capturemax int
+	scpmaxfile int
+	scpquota   int
+	ratelimits string
+	parents    []int
+}
+
+func (sb *SqliteBackend) queryInts(query string, args ...interface{}) (ids []int, err error) {
+	rows, err := sb.db.Query(query, args...)
+	if err != nil {
+		log.Error("%s", err.Error())
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int
+		err = rows.Scan(&id)
+		if err != nil {
+			log.Error("%s", err.Error())
+			return
+		}
+		ids = append(ids, id)
+	}
+	err = rows.Err()
+	return
+}
+
+func (sb *SqliteBackend) loadGroups() (groups map[int]*sqliteGroup, err error) {
+	groups = make(map[int]*sqliteGroup, 0)
+
+	rows, err := sb.db.Query("SELECT id, perms, cmdrules, dlprules, execallow, execdeny, capture, capturemax, scpmaxfile, scpquota, ratelimits FROM groups")
+	if err != nil {
+		log.Error("%s", err.Error())
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int
+		var perms, cmdrules, dlprules, execallow, execdeny, capture, ratelimits sql.NullString
+		var capturemax, scpmaxfile, scpquota sql.NullInt64
+		err = rows.Scan(&id, &perms, &cmdrules, &dlprules, &execallow, &execdeny,
+			&capture, &capturemax, &scpmaxfile, &scpquota, &ratelimits)
+		if err != nil {
+			log.Error("%s", err.Error())
+			return
+		}
+		groups[id] = &sqliteGroup{
+			perms:      splitPerms(perms.String),
+			cmdrules:   cmdrules.String,
+			dlprules:   dlprules.String,
+			execallow:  execallow.String,
+			execdeny:   execdeny.String,
+			capture:    capture.String,
+			capturemax: int(capturemax.Int64),
+			scpmaxfile: int(scpmaxfile.Int64),
+			scpquota:   int(scpquota.Int64),
+			ratelimits: ratelimits.String,
+		}
+	}
+	err = rows.Err()
+	if err != nil {
+		return
+	}
+
+	rows, err = sb.db.Query("SELECT childid, parentid FROM group_group")
+	if err != nil {
+		log.Error("%s", err.Error())
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var childid, parentid int
+		err = rows.Scan(&childid, &parentid)
+		if err != nil {
+			log.Error("%s", err.Error())
+			return
+		}
+		if g, ok := groups[childid]; ok {
+			g.parents = append(g.parents, parentid)
+		}
+	}
+	err = rows.Err()
+	return
+}
+
+// calGroup is the port of cal_group in web/db.py.
+// Walk up from every group of the user, collect +/- perms on the way,
+// until reach a group of the account. Paths are intersected, and a perm
+// is granted if it got a + and no - on what left.
+func (sb *SqliteBackend) calGroup(username string, accountid int) (perms []string, err error) {
+	groups, err := sb.loadGroups()
+	if err != nil {
+		return
+	}
+
+	ugs, err := sb.queryInts(
+		"SELECT groups_id FROM user_group WHERE users_username=?", username)
+	if err != nil {
+		return
+	}
+
+	ags, err := sb.queryInts(
+		"SELECT groups_id FROM account_group WHERE accounts_id=?", accountid)
+	if err != nil {
+		return
+	}
+	ag := make(map[int]bool, 0)
+	for _, id := range ags {
+		ag[id] = true
+	}
+
+	var search func(id int, ps map[string]bool, visited map[int]bool) map[string]bool
+	var searchList func(ids []int, ps map[string]bool, visited map[int]bool) map[string]bool
+
+	search = func(id int, ps map[string]bool, visited map[int]bool) map[string]bool {
+		g, ok := groups[id]
+		if !ok || visited[id] {
+			return nil
+		}
+		n := make(map[string]bool, len(ps)+len(g.perms))
+		for p := range ps {
+			n[p] = true
+		}
+		for _, p := range g.perms {
+			n[p] = true
+		}
+		if ag[id] {
+			return n
+		}
+
+		visited[id] = true
+		defer delete(visited, id)
+		return searchList(g.parents, n, visited)
+	}
+
+	searchList = func(ids []int, ps map[string]bool, visited map[int]bool) (rslt map[string]bool) {
+		for _, id := range ids {
+			r := search(id, ps, visited)
+			if len(r) == 0 {
+				continue
+			}
+			if rslt == nil {
+				rslt = r
+				continue
+			}
+			for p := range rslt {
+				if !r[p] {
+					delete(rslt, p)
+				}
+			}
+		}
+		return
+	}
+
+	signs := make(map[string]string, 0)
+	for p := range searchList(ugs, nil, make(map[int]bool, 0)) {
+		if len(p) < 2 {
+			continue
+		}
+		signs[p[1:]] += p[:1]
+	}
+	for name, s := range signs {
+		if strings.Contains(s, "+") && !strings.Contains(s, "-") {
+			perms = append(perms, name)
+		}
+	}
+	return
+}
+
+// pathGroups is the port of path_groups in web/db.py.
+// Groups on the way from groups of user up to groups of account.
+func (sb *SqliteBackend) pathGroups(username string, accountid int) (pgs []*sqliteGroup, err error) {
+	groups, err := sb.loadGroups()
+	if err != nil {
+		return
+	}
+
+	ugs, err := sb.queryInts(
+		"SELECT groups_id FROM user_group WHERE users_username=?", username)
+	if err != nil {
+		return
+	}
+
+	ags, err := sb.queryInts(
+		"SELECT groups_id FROM account_group WHERE accounts_id=?", accountid)
+	if err != nil {
+		return
+	}
+	ag := make(map[int]bool, 0)
+	for _, id := range ags {
+		ag[id] = true
+	}
+
+	onpath := make(map[int]bool, 0)
+	var search func(id int, path []int)
+	search = func(id int, path []int) {
+		g, ok := groups[id]
+		if !ok {
+			return
+		}
+		for _, p := range path {
+			if p == id {
+				return
+			}
+		}
+		path = append(path, id)
+		if ag[id] {
+			for _, p := range path {
+				onpath[p] = true
+			}
+			return
+		}
+		for _, parent := range g.parents {
+			search(parent, path)
+		}
+	}
+	for _, id := range ugs {
+		search(id, nil)
+	}
+
+	for id := range onpath {
+		pgs = append(pgs, groups[id])
+	}
+	return
+}
+
+// calRules collects rules on commands and files, and exec patterns of path groups.
+// The most thorough capture mode wins, with the largest limit of groups
+// in that mode. Limits of scp take the strictest one, so do rate limits
+// when parsed.
+func (sb *SqliteBackend) calRules(rslt *AccountRslt, username string) (err error) {
+	pgs, err := sb.pathGroups(username, rslt.Accountid)
+	if err != nil {
+		return
+	}
+	for _, g := range pgs {
+		rslt.CmdRules = append(rslt.CmdRules, ParseCmdRules(g.cmdrules)...)
+		rslt.DlpRules = append(rslt.DlpRules, ParseDlpRules(g.dlprules)...)
+		rslt.ExecAllow = append(rslt.ExecAllow, splitLines(g.execallow)...)
+		rslt.ExecDeny = append(rslt.ExecDeny, splitLines(g.execdeny)...)
+		rslt.RateLimits = append(rslt.RateLimits, splitLines(g.ratelimits)...)
+
+		rslt.ScpMaxFile = minLimit(rslt.ScpMaxFile, g.scpmaxfile)
+		rslt.ScpQuota = minLimit(rslt.ScpQuota, g.scpquota)
+
+		switch {
+		case captureLevel[g.capture] > captureLevel[rslt.Capture]:
+			rslt.Capture, rslt.CaptureMax = g.capture, g.capturemax
+		case g.capture == "" || g.capture != rslt.Capture || rslt.CaptureMax == 0:
+		case g.capturemax == 0 || g.capturemax > rslt.CaptureMax:
+			rslt.CaptureMax = g.capturemax
+		}
+	}
+	return
+}
+
+// minLimit returns the smaller limit, 0 means no limit.
+func minLimit(a, b int) int {
+	if a == 0 || (b != 0 && b < a) {
+		return b
+	}
+	return a
+}
+
+func (sb *SqliteBackend) InsertRecord(username, account, host string) (recordid int, starttime time.Time, err error) {
+	r, err := sb.db.Exec(
+		"INSERT INTO records (username, account, host, starttime) VALUES (?, ?, ?, CURRENT_TIMESTAMP)",
+		username, account, host)
+	if err != nil {
+		log.Error("%s", err.Error())
+		return
+	}
+	id, err := r.LastInsertId()
+	if err != nil {
+		log.Error("%s", err.Error())
+		return
+	}
+	recordid = int(id)
+
+	err = sb.db.QueryRow(
+		"SELECT starttime FROM records WHERE id=?", recordid).Scan(&starttime)
+	if err != nil {
+		log.Error("%s", err.Error())
+		return
+	}
+	return
+}
+
+func (sb *SqliteBackend) UpdateEndtime(recordid int) (err error) {
+	_, err = sb.db.Exec(
+		"UPDATE records SET endtime=CURRENT_TIMESTAMP WHERE id=?", recordid)
+	if err != nil {
+		log.Error("%s", err.Error())
+	}
+	return
+}
+
+func (sb *SqliteBackend) InsertRecordLogs(recordid int, rltype, log1, log2 string, num1 int) (id int, err error) {
+	r, err := sb.db.Exec(
+		"INSERT INTO recordlogs (recordid, time, type, log1, log2, num1) VALUES (?, CURRENT_TIMESTAMP, ?, ?, ?, ?)",
+		recordid, rltype, log1, log2, num1)
+	if err != nil {
+		log.Error("%s", err.Error())
+		return
+	}
+	i, err := r.LastInsertId()
+	if err != nil {
+		log.Error("%s", err.Error())
+		return
+	}
+	return int(i), nil
+}
+
+func (sb *SqliteBackend) UpdateRecordLogsHash(recordlogid int, hash string) (err error) {
+	_, err = sb.db.Exec(
+		"UPDATE recordlogs SET hash=? WHERE id=?", hash, recordlogid)
+	if err != nil {
+		log.Error("%s", err.Error())
+	}
+	return
+}
+
+func (sb *SqliteBackend) InsertAuditLogs(username, l string) (err error) {
+	log.Info("%s", l)
+	_, err = sb.db.Exec(
+		"INSERT INTO auditlogs (time, username, log) VALUES (CURRENT_TIMESTAMP, ?, ?)",
+		username, l)
+	if err != nil {
+		log.Error("%s", err.Error())
+	}
+	return
+}
+
+func (sb *SqliteBackend) CheckReview(username string, recordlogid int) (access bool, starttime time.Time, err error) {
+	user, err := sb.GetUser(username)
+	if err != nil {
+		return
+	}
+
+	err = sb.db.QueryRow(`SELECT r.starttime FROM recordlogs l
+JOIN records r ON l.recordid=r.id WHERE l.id=?`, recordlogid).Scan(&starttime)
+	if err == sql.ErrNoRows {
+		err = ErrRecordNotExist
+	}
+	if err != nil {
+		log.Error("%s", err.Error())
+		return
+	}
+
+	access = user.ChkRule("audit")
+	if !access {
+		return
+	}
+
+	err = sb.InsertAuditLogs(username, fmt.Sprintf("view sess id: %d", recordlogid))
+	return
+}
+
+func splitPerms(s string) (perms []string) {
+	for _, p := range strings.Split(s, ",") {
+		p = strings.TrimSpace(p)
+		if p != "" {
+			perms = append(perms, p)
+		}
+	}
+	return
+}
+
+func splitLines(s string) (lines []string) {
+	for _, l := range strings.Split(s, "\n") {
+		l = strings.TrimSpace(l)
+		if l != "" && !strings.HasPrefix(l, "#") {
+			lines = append(lines, l)
+		}
+	}
+	return
+}
@@ -0,0 +1,196 @@
+package sshproxy
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// classes of channel types in rate limits, "all" covers every type.
+var chanClass = map[string]string{
+	"shell":    "shell",
+	"exec":     "exec",
+	"scpto":    "scp",
+	"scpfrom":  "scp",
+	"sftp":     "scp",
+	"local":    "tcp",
+	"remote":   "tcp",
+	"sshagent": "tcp",
+}
+
+// TokenBucket limits rate in bytes per second, with burst of one second.
+// Tokens can go below zero, and the one who takes them waits it back,
+// so writes larger than burst work too.
+type TokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func CreateTokenBucket(rate int) (tb *TokenBucket) {
+	return &TokenBucket{
+		rate:   float64(rate),
+		tokens: float64(rate),
+		last:   time.Now(),
+	}
+}
+
+// reserve takes n tokens, returns how long to wait for them.
+func (tb *TokenBucket) reserve(n int) (d time.Duration) {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	now := time.Now()
+	tb.tokens += now.Sub(tb.last).Seconds() * tb.rate
+	if tb.tokens > tb.rate {
+		tb.tokens = tb.rate
+	}
+	tb.last = now
+
+	tb.tokens -= float64(n)
+	if tb.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-tb.tokens / tb.rate * float64(time.Second))
+}
+
+// Throttle waits for buckets before data goes on. Put it first in writers
+// of MultiCopyClose, the others get data after the wait.
+type Throttle []*TokenBucket
+
+func (t Throttle) Write(p []byte) (n int, err error) {
+	var wait time.Duration
+	for _, tb := range t {
+		if d := tb.reserve(len(p)); d > wait {
+			wait = d
+		}
+	}
+	time.Sleep(wait)
+	return len(p), nil
+}
+
+func (t Throttle) Close() error {
+	return nil
+}
+
+// ParseRate parses bytes per second, such as 512k or 10m.
+func ParseRate(s string) (rate int, err error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	unit := 1
+	switch {
+	case strings.HasSuffix(s, "k"):
+		unit = 1 << 10
+	case strings.HasSuffix(s, "m"):
+		unit = 1 << 20
+	case strings.HasSuffix(s, "g"):
+		unit = 1 << 30
+	}
+	if unit != 1 {
+		s = s[:len(s)-1]
+	}
+	rate, err = strconv.Atoi(s)
+	if err != nil {
+		log.Error("%s", err.Error())
+		return
+	}
+	if rate <= 0 {
+		err = fmt.Errorf("illegal rate: %s", s)
+		log.Error("%s", err.Error())
+		return
+	}
+	return rate * unit, nil
+}
+
+// parseRateLimits reads lines like "scp 1m", the lowest rate of a class wins.
+func parseRateLimits(lines []string) (limits map[string]int, err error) {
+	limits = make(map[string]int, 0)
+	for _, line := range lines {
+		i := strings.Fields(line)
+		if len(i) != 2 {
+			err = fmt.Errorf("illegal rate limit: %s", line)
+			log.Error("%s", err.Error())
+			return
+		}
+		class := i[0]
+		switch class {
+		case "all", "shell", "exec", "scp", "tcp":
+		default:
+			err = fmt.Errorf("illegal class of rate limit: %s", line)
+			log.Error("%s", err.Error())
+			return
+		}
+
+		var rate int
+		rate, err = ParseRate(i[1])
+		if err != nil {
+			return
+		}
+		if r, ok := limits[class]; !ok || rate < r {
+			limits[class] = rate
+		}
+	}
+	return
+}
+
+// sharedBucket is bucket of a user shared by connections, dropped when
+// the last of them closed.
+type sharedBucket struct {
+	tb   *TokenBucket
+	refs int
+}
+
+func bucketKey(username, class string, rate int) string {
+	return fmt.Sprintf("%s/%s/%d", username, class, rate)
+}
+
+// acquireBuckets returns buckets of username for classes in limits.
+func (srv *Server) acquireBuckets(username string, limits map[string]int) (buckets map[string]*TokenBucket) {
+	buckets = make(map[string]*TokenBucket, 0)
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	for class, rate := range limits {
+		key := bucketKey(username, class, rate)
+		sb, ok := srv.buckets[key]
+		if !ok {
+			sb = &sharedBucket{tb: CreateTokenBucket(rate)}
+			srv.buckets[key] = sb
+		}
+		sb.refs++
+		buckets[class] = sb.tb
+	}
+	return
+}
+
+// releaseBuckets gives back what acquireBuckets got.
+func (srv *Server) releaseBuckets(username string, limits map[string]int) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	for class, rate := range limits {
+		key := bucketKey(username, class, rate)
+		sb, ok := srv.buckets[key]
+		if !ok {
+			continue
+		}
+		sb.refs--
+		if sb.refs <= 0 {
+			delete(srv.buckets, key)
+		}
+	}
+}
+
+// throttle collects buckets of global cap, and user limits on the channel.
+func (chi *ChanInfo) throttle() (t Throttle) {
+	srv := chi.ci.srv
+	if srv.bucket != nil {
+		t = append(t, srv.bucket)
+	}
+	for _, class := range []string{chanClass[chi.Type], "all"} {
+		if tb, ok := chi.ci.buckets[class]; ok {
+			t = append(t, tb)
+		}
+	}
+	return
+}
@@ -0,0 +1,75 @@
+package sshproxy
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// totpStep is time-step of RFC 6238 at time t.
+func totpStep(t time.Time) int64 {
+	return t.Unix() / int64(TOTP_PERIOD/time.Second)
+}
+
+// TotpCode generates code of RFC 6238 at time t, with HMAC-SHA1.
+func TotpCode(secret []byte, t time.Time) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(totpStep(t)))
+
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	code := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	mod := uint32(1)
+	for i := 0; i < TOTP_DIGITS; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", TOTP_DIGITS, code%mod)
+}
+
+func decodeTotpSecret(secret string) ([]byte, error) {
+	secret = strings.ToUpper(strings.Replace(secret, " ", "", -1))
+	secret = strings.TrimRight(secret, "=")
+	return base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+}
+
+// CheckTotp verifies code against base32 secret, returns time-step of it,
+// 0 if not match. TOTP_SKEW periods before or after now are accepted.
+func CheckTotp(secret, code string) (step int64, err error) {
+	key, err := decodeTotpSecret(secret)
+	if err != nil {
+		log.Error("%s", err.Error())
+		return
+	}
+
+	code = strings.TrimSpace(code)
+	now := time.Now()
+	for i := -TOTP_SKEW; i <= TOTP_SKEW; i++ {
+		t := now.Add(time.Duration(i) * TOTP_PERIOD)
+		c := TotpCode(key, t)
+		if subtle.ConstantTimeCompare([]byte(c), []byte(code)) == 1 {
+			return totpStep(t), nil
+		}
+	}
+	return 0, nil
+}
+
+// useTotpStep marks step of username used, false if it or a later one
+// was used before. So code can't be replayed, as RFC 6238 5.2 says.
+func (srv *Server) useTotpStep(username string, step int64) bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if step <= srv.steps[username] {
+		return false
+	}
+	srv.steps[username] = step
+	return true
+}
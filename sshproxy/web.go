@@ -0,0 +1,210 @@
+package sshproxy
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+type WebBackend struct {
+	webhost string
+}
+
+func CreateWebBackend(webhost string) (wb *WebBackend) {
+	return &WebBackend{webhost: webhost}
+}
+
+func (wb *WebBackend) GetJson(base string, post bool, v *url.Values, obj interface{}) (err error) {
+	var resp *http.Response
+	if post {
+		u := fmt.Sprintf("http://%s%s", wb.webhost, base)
+		log.Info("post url: %s", u)
+		buf := bytes.NewBufferString(v.Encode())
+		resp, err = http.Post(u, "application/x-www-form-urlencoded", buf)
+	} else {
+		u := fmt.Sprintf("http://%s%s?%s", wb.webhost, base, v.Encode())
+		log.Info("get url: %s", u)
+		resp, err = http.Get(u)
+	}
+	if err != nil {
+		log.Error("query failed: %s", err.Error())
+		return
+	}
+	defer resp.Body.Close()
+
+	if obj == nil {
+		return
+	}
+
+	dec := json.NewDecoder(resp.Body)
+	err = dec.Decode(&obj)
+	if err != nil {
+		log.Error("decode json failed: %s", err.Error())
+		return
+	}
+	return
+}
+
+func (wb *WebBackend) GetConfig() (cfg *WebConfig, err error) {
+	cfg = &WebConfig{}
+	err = wb.GetJson("/l/cfg", false, &url.Values{}, cfg)
+	return
+}
+
+func (wb *WebBackend) GetUser(username string) (user *UserInfo, err error) {
+	v := &url.Values{}
+	v.Add("username", username)
+
+	user = &UserInfo{}
+	err = wb.GetJson("/l/usr", false, v, user)
+	if err != nil {
+		return
+	}
+	if user.Username == "" {
+		return nil, ErrUserNotExist
+	}
+	return
+}
+
+func (wb *WebBackend) FindPubkey(key ssh.PublicKey) (username string, err error) {
+	pubkey := base64.StdEncoding.EncodeToString(key.Marshal())
+	v := &url.Values{}
+	v.Add("pubkey", pubkey)
+
+	type PubkeyRslt struct {
+		Name     string
+		Username string
+	}
+	rslt := &PubkeyRslt{}
+
+	err = wb.GetJson("/l/pubk", false, v, rslt)
+	if err != nil {
+		return
+	}
+	username = rslt.Username
+	return
+}
+
+func (wb *WebBackend) GetAccount(username, account, host string) (rslt *AccountRslt, err error) {
+	v := &url.Values{}
+	v.Add("username", username)
+	v.Add("account", account)
+	v.Add("host", host)
+
+	rslt = &AccountRslt{}
+	err = wb.GetJson("/l/h", false, v, rslt)
+	return
+}
+
+func (wb *WebBackend) GetAccounts(username string) (accounts []*AccountName, err error) {
+	v := &url.Values{}
+	v.Add("username", username)
+
+	type AccountsRslt struct {
+		Accounts []*AccountName
+	}
+	rslt := &AccountsRslt{}
+
+	err = wb.GetJson("/l/accts", false, v, rslt)
+	if err != nil {
+		return
+	}
+	return rslt.Accounts, nil
+}
+
+func (wb *WebBackend) InsertRecord(username, account, host string) (recordid int, starttime time.Time, err error) {
+	v := &url.Values{}
+	v.Add("username", username)
+	v.Add("account", account)
+	v.Add("host", host)
+
+	type RecordRslt struct {
+		Recordid  int
+		Starttime string
+	}
+	rslt := &RecordRslt{}
+
+	err = wb.GetJson("/l/rec", true, v, rslt)
+	if err != nil {
+		return
+	}
+	recordid = rslt.Recordid
+	starttime, err = time.Parse("2006-01-02T15:04:05", rslt.Starttime)
+	if err != nil {
+		log.Error("%s", err.Error())
+		return
+	}
+	return
+}
+
+func (wb *WebBackend) UpdateEndtime(recordid int) (err error) {
+	v := &url.Values{}
+	v.Add("recordid", fmt.Sprintf("%d", recordid))
+	return wb.GetJson("/l/end", true, v, nil)
+}
+
+func (wb *WebBackend) InsertRecordLogs(recordid int, rltype, log1, log2 string, num1 int) (id int, err error) {
+	v := &url.Values{}
+	v.Add("recordid", fmt.Sprintf("%d", recordid))
+	v.Add("type", rltype)
+	v.Add("log1", log1)
+	v.Add("log2", log2)
+	v.Add("num1", fmt.Sprintf("%d", num1))
+
+	type RecordLogsRslt struct {
+		Id int
+	}
+	rslt := &RecordLogsRslt{}
+
+	err = wb.GetJson("/l/rlog", true, v, rslt)
+	if err != nil {
+		return
+	}
+	id = rslt.Id
+	return
+}
+
+func (wb *WebBackend) UpdateRecordLogsHash(recordlogid int, hash string) (err error) {
+	v := &url.Values{}
+	v.Add("recordlogid", fmt.Sprintf("%d", recordlogid))
+	v.Add("hash", hash)
+	return wb.GetJson("/l/rlogh", true, v, nil)
+}
+
+func (wb *WebBackend) InsertAuditLogs(username, l string) (err error) {
+	v := &url.Values{}
+	v.Add("username", username)
+	v.Add("log", l)
+	return wb.GetJson("/l/alog", true, v, nil)
+}
+
+func (wb *WebBackend) CheckReview(username string, recordlogid int) (access bool, starttime time.Time, err error) {
+	v := &url.Values{}
+	v.Add("username", username)
+	v.Add("recordlogid", fmt.Sprintf("%d", recordlogid))
+
+	type ReviewRslt struct {
+		Access bool
+		Time   string
+	}
+	rslt := &ReviewRslt{}
+
+	err = wb.GetJson("/l/rev", false, v, rslt)
+	if err != nil {
+		return
+	}
+
+	starttime, err = time.Parse("2006-01-02T15:04:05", rslt.Time)
+	if err != nil {
+		log.Error("%s", err.Error())
+		return
+	}
+	access = rslt.Access
+	return
+}
@@ -14,14 +14,18 @@ from sqlalchemy.ext.declarative import declarative_base
 __all__ = [
     'Users', 'Pubkeys', 'Hosts', 'Accounts', 'GroupGroup', 'Groups',
     'Records', 'RecordLogs', 'AuditLogs',
-    'ALLRULES', 'PERMS', 'ALLPERMS',
-    'crypto_pass', 'check_pass', 'is_parent', 'cal_group',
+    'ALLRULES', 'PERMS', 'ALLPERMS', 'AUTHMETHODS', 'CAPTURES',
+    'crypto_pass', 'check_pass', 'is_parent', 'cal_group', 'cal_cmdrules',
+    'cal_dlprules', 'cal_execs', 'cal_capture', 'cal_scplimits',
+    'cal_ratelimits', 'migrate',
     'sqlalchemy', 'desc', 'or_']
 
 Base = declarative_base()
 
-ALLRULES = ['admin', 'audit']
-PERMS = ['shell', 'scpfrom', 'scpto', 'tcp', 'agent']
+ALLRULES = ['admin', 'audit', 'approve']
+AUTHMETHODS = ['publickey', 'password', 'keyboard-interactive']
+PERMS = ['shell', 'exec', 'scpfrom', 'scpto', 'sftp', 'tcp', 'remoteforward', 'agent']
+CAPTURES = ['', 'hash', 'full']
 
 addx = lambda c: lambda x: c + x
 ALLPERMS = map(addx('+'), PERMS) + map(addx('-'), PERMS)
@@ -39,6 +43,10 @@ class Users(Base):
     email = Column(String)
     pubkeys = relationship("Pubkeys", backref='user')
     perms = Column(String, nullable=False)
+    # empty means publickey only.
+    authmethods = Column(String)
+    # base32 secret of totp, empty means not enrolled.
+    totp = Column(String)
 
 class Pubkeys(Base):
     __tablename__ = 'pubkeys'
@@ -57,6 +65,7 @@ class Hosts(Base):
     proxyaccount = Column(Integer, ForeignKey('accounts.id', use_alter=True, name='hosts_proxy_account'))
     proxy = relationship("Accounts", foreign_keys=[proxyaccount,])
     hostkeys = Column(String, nullable=False)
+    sensitive = Column(Boolean, default=False)
 
 class Accounts(Base):
     __tablename__ = 'accounts'
@@ -94,6 +103,21 @@ class Groups(Base):
     users = relationship("Users", backref='groups', secondary=user_group)
     accounts = relationship("Accounts", backref='groups', secondary=account_group)
     perms = Column(String)
+    # rules on commands, one per line: warn|block|kill regex.
+    cmdrules = Column(String)
+    # rules on content of files transferred: log|alert|abort @privatekey|@creditcard|regex.
+    dlprules = Column(String)
+    # patterns of exec command line, one per line.
+    execallow = Column(String)
+    execdeny = Column(String)
+    # capture of transferred files: hash or full, and max size to store.
+    capture = Column(String)
+    capturemax = Column(Integer)
+    # limits of scp in bytes: largest file, and total of a session.
+    scpmaxfile = Column(Integer)
+    scpquota = Column(Integer)
+    # bandwidth, one per line: all|shell|exec|scp|tcp bytes/s, such as "scp 1m".
+    ratelimits = Column(String)
     after = Column(String)
     before = Column(String)
 
@@ -116,6 +140,8 @@ class RecordLogs(Base):
     log1 = Column(String)
     log2 = Column(String)
     num1 = Column(Integer)
+    # sha256 of file transferred, if captured.
+    hash = Column(String)
 
 class AuditLogs(Base):
     __tablename__ = 'auditlogs'
@@ -144,6 +170,104 @@ def cal_group(user, acct):
         rslt.setdefault(p[1:], []).append(p[0])
     return [k for k, l in rslt.items() if ('-' not in l) and ('+' in l)]
 
+def path_groups(user, acct):
+    ag, rslt = acct.groups, set()
+    def search(g, path):
+        if g in path: return
+        path = path + [g]
+        if g in ag:
+            rslt.update(path)
+            return
+        for gg in g.parents: search(gg.parent, path)
+    for g in user.groups: search(g, [])
+    return rslt
+
+def split_lines(s):
+    lines = [line.strip() for line in (s or '').splitlines()]
+    return [line for line in lines if line and not line.startswith('#')]
+
+def parse_rules(s):
+    rules = []
+    for line in split_lines(s):
+        action, pattern = (line.split(' ', 1) + [''])[:2]
+        rules.append({'action': action, 'pattern': pattern.strip()})
+    return rules
+
+def cal_cmdrules(user, acct):
+    rules = []
+    for g in path_groups(user, acct):
+        rules.extend(parse_rules(g.cmdrules))
+    return rules
+
+def cal_dlprules(user, acct):
+    rules = []
+    for g in path_groups(user, acct):
+        rules.extend(parse_rules(g.dlprules))
+    return rules
+
+def cal_execs(user, acct):
+    allow, deny = [], []
+    for g in path_groups(user, acct):
+        allow.extend(split_lines(g.execallow))
+        deny.extend(split_lines(g.execdeny))
+    return allow, deny
+
+def cal_capture(user, acct):
+    mode, max = '', 0
+    for g in path_groups(user, acct):
+        c = g.capture or ''
+        if CAPTURES.index(c) > CAPTURES.index(mode):
+            mode, max = c, g.capturemax or 0
+        elif c and c == mode and max and (not g.capturemax or g.capturemax > max):
+            max = g.capturemax
+    return mode, max
+
+def min_limit(a, b):
+    if not a or (b and b < a): return b or 0
+    return a
+
+def cal_scplimits(user, acct):
+    maxfile, quota = 0, 0
+    for g in path_groups(user, acct):
+        maxfile = min_limit(maxfile, g.scpmaxfile)
+        quota = min_limit(quota, g.scpquota)
+    return maxfile, quota
+
+def cal_ratelimits(user, acct):
+    limits = []
+    for g in path_groups(user, acct):
+        limits.extend(split_lines(g.ratelimits))
+    return limits
+
+# columns added to tables after first release, as table.column.
+# the sqlite backend of sshproxy reads them, so old databases need them too.
+MIGRATIONS = [
+    'users.authmethods',
+    'users.totp',
+    'hosts.sensitive',
+    'groups.cmdrules',
+    'groups.execallow',
+    'groups.execdeny',
+    'groups.capture',
+    'groups.capturemax',
+    'recordlogs.hash',
+    'groups.dlprules',
+    'groups.scpmaxfile',
+    'groups.scpquota',
+    'groups.ratelimits',
+]
+
+def migrate(engine):
+    from sqlalchemy.engine.reflection import Inspector
+    insp = Inspector.from_engine(engine)
+    for name in MIGRATIONS:
+        table, column = name.split('.')
+        if column in [c['name'] for c in insp.get_columns(table)]:
+            continue
+        col = Base.metadata.tables[table].c[column]
+        engine.execute('ALTER TABLE %s ADD COLUMN %s %s' % (
+            table, column, col.type.compile(dialect=engine.dialect)))
+
 def main():
     import getopt, subprocess, ConfigParser
     optlist, args = getopt.getopt(sys.argv[1:], 'bc:hx')
@@ -159,6 +283,7 @@ def main():
 
     if '-b' in optdict:
         Base.metadata.create_all(engine)
+        migrate(engine)
 
     # import pubkey for user
     if '-x' in optdict:
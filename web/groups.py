@@ -37,6 +37,14 @@ def _select(session):
 def _add(session):
     return template('grp_edit.html', group=Groups(perms=''))
 
+def capture():
+    c = request.forms.capture
+    return c if c in CAPTURES else ''
+
+def intform(name):
+    try: return int(request.forms.get(name) or 0)
+    except ValueError: return 0
+
 @route('/grp/add', method="POST")
 @utils.chklogin('admin')
 def _add(session):
@@ -50,7 +58,14 @@ def _add(session):
     perms = set(request.forms.getall('perms')) & set(ALLPERMS)
     perms = ','.join(perms)
     utils.log(logger, 'create group %s, perms: %s' % (name, perms))
-    group = Groups(name=name, perms=perms)
+    group = Groups(name=name, perms=perms, cmdrules=request.forms.cmdrules,
+                   dlprules=request.forms.dlprules,
+                   execallow=request.forms.execallow,
+                   execdeny=request.forms.execdeny,
+                   capture=capture(), capturemax=intform('capturemax'),
+                   scpmaxfile=intform('scpmaxfile'),
+                   scpquota=intform('scpquota'),
+                   ratelimits=request.forms.ratelimits)
     sess.add(group)
     sess.commit()
     return bottle.redirect('/grp/')
@@ -74,6 +89,14 @@ def _edit(session, id):
     perms = ','.join(perms)
     group.perms = perms
     group.name = request.forms.name
+    group.cmdrules = request.forms.cmdrules
+    group.dlprules = request.forms.dlprules
+    group.execallow = request.forms.execallow
+    group.execdeny = request.forms.execdeny
+    group.capture, group.capturemax = capture(), intform('capturemax')
+    group.scpmaxfile = intform('scpmaxfile')
+    group.scpquota = intform('scpquota')
+    group.ratelimits = request.forms.ratelimits
 
     utils.log(logger, 'change group name %s => %s, perms: %s => %s' % (
         group.name, request.forms.name, group.perms, perms))
@@ -48,6 +48,7 @@ def _add(session):
         host=request.forms.get('host'),
         hostname=request.forms.get('hostname'),
         port=int(request.forms.get('port')),
+        sensitive=bool(request.forms.get('sensitive')),
         hostkeys='')
     sess.add(host)
 
@@ -85,6 +86,7 @@ def _edit(session, id):
     host.hostname = request.forms.get('hostname')
     host.port = int(request.forms.get('port'))
     host.proxycommand = request.forms.get('proxycommand')
+    host.sensitive = bool(request.forms.get('sensitive'))
 
     if request.forms.get('proxyaccount'):
         a, h = request.forms.get('proxyaccount').split('@', 1)
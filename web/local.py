@@ -13,6 +13,8 @@ logger = logging.getLogger('local')
 app = bottle.default_app()
 sess = app.config['db.session']
 
+MAX_HOPS = 8
+
 def chklocal(func):
     def _inner(*p, **kw):
         ip = request.remote_route[0] if request.remote_route else request.remote_addr
@@ -27,6 +29,10 @@ def _config():
     r = dict([(k[6:], v) for k, v in app.config.iteritems()
               if k.startswith('proxy.')])
     with open(r['hostkey'], 'rb') as fi: r['hostkey'] = fi.read()
+    for k in ('userca', 'accountca'):
+        if r.get(k):
+            with open(r[k], 'rb') as fi: r[k] = fi.read()
+    r['livenotice'] = r.get('livenotice', '').lower() in ('1', 'true', 'yes')
     return r
 
 @route('/l/pubk')
@@ -37,11 +43,24 @@ def _query():
         return {'errmsg': 'pubkey not exist.'}
     return {'name': pubk.name, 'username': pubk.username}
 
+@route('/l/usr')
+@chklocal
+@utils.jsonenc
+def _query():
+    user = sess.query(Users).filter_by(username=request.query.username).scalar()
+    if not user:
+        return {'errmsg': 'user not exist.'}
+    return {'username': user.username, 'password': user.password,
+            'perms': filter(bool, user.perms.split(',')),
+            'authmethods': filter(bool, (user.authmethods or '').split(',')),
+            'totpsecret': user.totp or ''}
+
 def acct_dict(acct):
     return {'hostid': acct.host.id, 'hostname': acct.host.hostname,
             'port': acct.host.port, 'hostkey': acct.host.hostkeys,
             'accountid': acct.id, 'account': acct.account,
-            'key': acct.key, 'password': acct.password}
+            'key': acct.key, 'password': acct.password,
+            'sensitive': bool(acct.host.sensitive)}
 
 @route('/l/h')
 @chklocal
@@ -63,11 +82,38 @@ def _query():
 
     r = acct_dict(acct)
     r['perms'] = cal_group(user, acct)
-    if acct.host.proxy:
-        r['proxy'] = acct_dict(acct.host.proxy)
-        r['proxycommand'] = acct.host.proxycommand
+    r['cmdrules'] = cal_cmdrules(user, acct)
+    r['dlprules'] = cal_dlprules(user, acct)
+    r['execallow'], r['execdeny'] = cal_execs(user, acct)
+    r['capture'], r['capturemax'] = cal_capture(user, acct)
+    r['scpmaxfile'], r['scpquota'] = cal_scplimits(user, acct)
+    r['ratelimits'] = cal_ratelimits(user, acct)
+
+    # follow proxy account of host, the first hop is dialed directly.
+    r['hops'], h = [], acct.host
+    while h.proxy:
+        if len(r['hops']) >= MAX_HOPS:
+            return {'errmsg': 'too many hops.'}
+        hop = acct_dict(h.proxy)
+        hop['proxycommand'] = h.proxycommand
+        r['hops'].insert(0, hop)
+        h = h.proxy.host
     return r
 
+@route('/l/accts')
+@chklocal
+@utils.jsonenc
+def _query():
+    username = request.query.get('username')
+    user = sess.query(Users).filter_by(username=username).scalar()
+    if not user:
+        return {'errmsg': 'user not exist.'}
+
+    accounts = []
+    for acct in sess.query(Accounts):
+        if not cal_group(user, acct): continue
+        accounts.append({'account': acct.account, 'host': acct.host.host})
+    return {'accounts': accounts}
 
 @route('/l/rec', method='POST')
 @chklocal
@@ -114,6 +160,29 @@ def _add():
     sess.commit()
     return {'id': rlog.id}
 
+@route('/l/rlogh', method='POST')
+@chklocal
+@utils.jsonenc
+def _hash():
+    rlog = sess.query(RecordLogs).filter_by(
+        id=request.forms.get('recordlogid')).scalar()
+    if not rlog:
+        return {'errmsg': 'recordlog not exist'}
+    rlog.hash = request.forms.get('hash')
+    sess.commit()
+    return
+
+@route('/l/alog', method='POST')
+@chklocal
+@utils.jsonenc
+def _add():
+    username = request.forms.get('username')
+    log = request.forms.get('log')
+    logger.info(log)
+    sess.add(AuditLogs(username=username, log=log))
+    sess.commit()
+    return
+
 @route('/l/rev')
 @chklocal
 @utils.jsonenc
@@ -24,6 +24,8 @@ app.config['db.session'] = sess
 import utils
 utils.initlog(app.config.get('log.level', 'INFO'),
               app.config.get('log.logfile', ''))
+import db
+db.migrate(engine)
 
 session_opts = {
     'session.type': 'ext:database',
@@ -72,16 +72,34 @@ def _show(session, id):
     sess.commit()
     return utils.paged_template('rec.html', _reclogs=reclogs)
 
+REC_MAGIC = 'SSHPREC\x02'
 header = struct.Struct('>BH')
+header2 = struct.Struct('>BIH')
 def read_sublog(s, b):
+    if s.read(len(REC_MAGIC)) != REC_MAGIC:
+        # version 1, no timestamp.
+        s.seek(0)
+        while True:
+            d = s.read(3)
+            if not d: return
+            t, l = header.unpack(d)
+            d = s.read(l)
+            if b != t: continue
+            yield d
+            time.sleep(0.2)
+
+    l, = struct.unpack('>I', s.read(4))
+    s.read(l)
+    last = 0
     while True:
-        d = s.read(3)
+        d = s.read(header2.size)
         if not d: return
-        t, l = header.unpack(d)
+        t, ms, l = header2.unpack(d)
         d = s.read(l)
         if b != t: continue
+        time.sleep(max(ms - last, 0) / 1000.0)
+        last = ms
         yield d
-        time.sleep(0.2)
 
 @route('/rlog/<id:int>')
 @utils.chklogin('audit')
@@ -87,9 +87,13 @@ def _add(session):
 
     perms = set(request.forms.getall('perms')) & set(ALLRULES)
     perms = ','.join(perms)
-    utils.log(logger, 'create user %s, perms: %s' % (username, perms))
+    authmethods = set(request.forms.getall('authmethods')) & set(AUTHMETHODS)
+    authmethods = ','.join(authmethods)
+    utils.log(logger, 'create user %s, perms: %s, auth methods: %s' % (
+            username, perms, authmethods))
     user = Users(
-        username=username, password=crypto_pass(password1), perms=perms)
+        username=username, password=crypto_pass(password1), perms=perms,
+        authmethods=authmethods, totp=request.forms.get('totp') or None)
     sess.add(user)
     sess.commit()
     return bottle.redirect('/usr/')
@@ -126,6 +130,17 @@ def _edit(session, username):
     utils.log(logger, 'change perm from %s to %s for user %s' % (
             user.perms, perms, user.username))
     user.perms = perms
+
+    authmethods = set(request.forms.getall('authmethods')) & set(AUTHMETHODS)
+    authmethods = ','.join(authmethods)
+    utils.log(logger, 'change auth methods from %s to %s for user %s' % (
+            user.authmethods, authmethods, user.username))
+    user.authmethods = authmethods
+
+    totp = request.forms.get('totp') or None
+    if totp != user.totp:
+        utils.log(logger, 'change totp secret for user %s' % user.username)
+        user.totp = totp
     sess.commit()
     return bottle.redirect('/usr/')
 